@@ -15,7 +15,7 @@ export GOPATH=${PWD}/gopath
 mkdir -p "${PWD}/bin"
 
 echo "Building plugins"
-PLUGINS="ovs ipam/centralip"
+PLUGINS="ovs ipam/centralip ipam/centralip/heartbeat ipam/centralip/centralipctl"
 for d in $PLUGINS; do
 	if [ -d "$d" ]; then
 		plugin="$(basename "$d")"
@@ -18,10 +18,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/cluster"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/namespace"
 	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/node"
 	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
 	"github.com/containernetworking/cni/pkg/skel"
-	"os"
+	"github.com/containernetworking/cni/pkg/types"
 )
 
 type CentralNet struct {
@@ -30,21 +31,116 @@ type CentralNet struct {
 	IPM        *utils.IPMConfig `json:"ipam"`
 }
 
-func GenerateCentralIPM(args *skel.CmdArgs) (utils.CentralIPM, error, string) {
+// K8sArgs are the CNI_ARGS set by the kubelet
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+}
+
+// GenerateCentralIPM returns one IPM for each IP family configured in the
+// network, so that dual-stack networks get an IPv4 and an IPv6 address.
+func GenerateCentralIPM(args *skel.CmdArgs) ([]utils.CentralIPM, error, string) {
+	n, families, err := LoadIPMConfigs(args.StdinData)
+	if err != nil {
+		return nil, err, ""
+	}
+
+	//Only the pod identity is read, so other runtimes may pass any args
+	k8sArgs := K8sArgs{CommonArgs: types.CommonArgs{IgnoreUnknown: true}}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+		return nil, err, ""
+	}
+
+	var ipms []utils.CentralIPM
+	for _, config := range families {
+		if k8sArgs.K8S_POD_NAMESPACE != "" && k8sArgs.K8S_POD_NAME != "" {
+			config.Pod = string(k8sArgs.K8S_POD_NAMESPACE) + "/" + string(k8sArgs.K8S_POD_NAME)
+		}
+		ipm, err := newCentralIPM(args, config, k8sArgs)
+		if err != nil {
+			return nil, err, ""
+		}
+		ipms = append(ipms, ipm)
+	}
+	return ipms, nil, n.CNIVersion
+}
+
+// TrackNodeNames lets a renamed node take its subnet along instead of
+// registering a new one, in the node mode. Only ADD calls it, so DEL and
+// CHECK never change the keys of the node, and use the name the subnet is
+// registered under until then.
+func TrackNodeNames(args *skel.CmdArgs) error {
+	_, families, err := LoadIPMConfigs(args.StdinData)
+	if err != nil {
+		return err
+	}
+	for _, config := range families {
+		if config.IPType != "node" {
+			continue
+		}
+		name, err := utils.NodeName(config)
+		if err != nil {
+			return err
+		}
+		if err := utils.TrackNodeName(config, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadIPMConfigs parses the network config and returns the IPAM config of
+// each IP family, scoped by the network name.
+func LoadIPMConfigs(data []byte) (*CentralNet, []*utils.IPMConfig, error) {
 	n := &CentralNet{}
-	if err := json.Unmarshal(args.StdinData, n); err != nil {
-		return nil, fmt.Errorf("failed to load netconf: %v", err), ""
+	if err := json.Unmarshal(data, n); err != nil {
+		return nil, nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.IPM == nil {
+		return nil, nil, fmt.Errorf("The network %s has no ipam config", n.Name)
+	}
+
+	if err := utils.ValidateName(n.Name); err != nil {
+		return nil, nil, err
+	}
+	n.IPM.Name = n.Name
+
+	if err := utils.ValidateLease(n.IPM); err != nil {
+		return nil, nil, err
 	}
+	if err := utils.ValidateLocal(n.IPM); err != nil {
+		return nil, nil, err
+	}
+	if n.IPM.StickyHoldTime < 0 {
+		return nil, nil, fmt.Errorf("The stickyHoldTime should not be negative: %d", n.IPM.StickyHoldTime)
+	}
+
+	families, err := n.IPM.Families()
+	if err != nil {
+		return nil, nil, err
+	}
+	return n, families, nil
+}
 
-	switch n.IPM.IPType {
+func newCentralIPM(args *skel.CmdArgs, config *utils.IPMConfig, k8sArgs K8sArgs) (utils.CentralIPM, error) {
+	hostname, err := utils.NodeName(config)
+	if err != nil {
+		return nil, err
+	}
+	switch config.IPType {
 	case "node":
-		hostname, _ := os.Hostname()
-		node, err := node.New(args.ContainerID, hostname, n.IPM)
-		return node, err, n.CNIVersion
+		hostname, err = utils.RegisteredNodeName(config, hostname)
+		if err != nil {
+			return nil, err
+		}
+		return node.New(args.ContainerID, args.IfName, hostname, config)
 	case "cluster":
-		node, err := cluster.New(args.ContainerID, n.IPM)
-		return node, err, n.CNIVersion
+		return cluster.New(args.ContainerID, args.IfName, hostname, config)
+	case "namespace":
+		return namespace.New(args.ContainerID, args.IfName, hostname, string(k8sArgs.K8S_POD_NAMESPACE), config)
 	default:
-		return nil, fmt.Errorf("Unsupport IPM type %s", n.IPM.Type), ""
+		return nil, fmt.Errorf("Unsupport IPM type %s", config.Type)
 	}
 }
@@ -15,14 +15,46 @@
 package centralip
 
 import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/etcdtest"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
-var validNodeData = skel.CmdArgs{
-	StdinData: []byte(`
+var etcdURL string
+var nodeStatePath string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "centralip")
+	if err != nil {
+		panic(err)
+	}
+	nodeStatePath = filepath.Join(dir, "node.json")
+	code := etcdtest.Main(m, &etcdURL)
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// cmdArgs returns the args of a CNI call with conf, pointed at the test etcd
+// and at a node state file of the test
+func cmdArgs(containerID, conf string) *skel.CmdArgs {
+	data := fmt.Sprintf(conf, etcdURL)
+	data = strings.Replace(data, `"ipam":{`, `"ipam":{"nodeStatePath":"`+nodeStatePath+`",`, 1)
+	return &skel.CmdArgs{
+		ContainerID: containerID,
+		IfName:      "eth0",
+		StdinData:   []byte(data),
+	}
+}
+
+const validNodeData = `
 	{
 		"name":"mynet",
 		"cniVersion":"0.3.1",
@@ -33,14 +65,28 @@ var validNodeData = skel.CmdArgs{
 			"subnetLen": 24,
 			"subnetMin": "10.245.5.0",
 			"subnetMax": "10.245.6.0",
-			"etcdURL": "127.0.0.1:2379"
+			"etcdURL": "%s"
 		}
 	}
-	`),
-}
+	`
 
-var InvalidData = skel.CmdArgs{
-	StdinData: []byte(`
+const validDualStackData = `
+	{
+		"name":"mynet",
+		"cniVersion":"0.3.1",
+		"ipam":{
+			"type":"central",
+			"ipType": "cluster",
+			"network":"10.245.0.0/16",
+			"etcdURL": "%s",
+			"ipv6": {
+				"network":"fd00:245::/64"
+			}
+		}
+	}
+	`
+
+const InvalidData = `
 	{
 		"name":"mynet",
 		"cniVersion":"0.3.1",
@@ -50,14 +96,12 @@ var InvalidData = skel.CmdArgs{
 			"subnetLen": 24,
 			"subnetMin": "10.245.5.0",
 			"subnetMax": "10.245.6.0",
-			"etcdURL": "127.0.0.1:2379"
+			"etcdURL": "%s"
 		}
 	}
-	`),
-}
+	`
 
-var validClusterData = skel.CmdArgs{
-	StdinData: []byte(`
+const validClusterData = `
 	{
 		"name":"mynet",
 		"cniVersion":"0.3.1",
@@ -68,38 +112,216 @@ var validClusterData = skel.CmdArgs{
 			"subnetLen": 24,
 			"subnetMin": "10.245.5.0",
 			"subnetMax": "10.245.6.0",
-			"etcdURL": "127.0.0.1:2379"
+			"etcdURL": "%s"
 		}
 
 	}
-	`),
-}
+	`
 
-func TestGenerateCentralIPM(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
+const validConcurrentData = `
+	{
+		"name":"concurrent",
+		"cniVersion":"0.3.1",
+		"ipam":{
+			"type":"central",
+			"ipType": "node",
+			"network":"10.246.0.0/16",
+			"subnetLen": 24,
+			"subnetMin": "10.246.5.0",
+			"subnetMax": "10.246.6.0",
+			"etcdURL": "%s"
+		}
 	}
+	`
+
+const validNamespaceData = `
+	{
+		"name":"tenants",
+		"cniVersion":"0.3.1",
+		"ipam":{
+			"type":"central",
+			"ipType": "namespace",
+			"network":"10.247.0.0/16",
+			"subnetLen": 24,
+			"subnetMin": "10.247.5.0",
+			"subnetMax": "10.247.6.0",
+			"etcdURL": "%s"
+		}
+	}
+	`
+
+func TestGenerateCentralIPM(t *testing.T) {
 	t.Run("Node instance", func(t *testing.T) {
-		n, err, version := GenerateCentralIPM(&validNodeData)
+		n, err, version := GenerateCentralIPM(cmdArgs("pod1", validNodeData))
 		assert.NoError(t, err)
 		assert.NotNil(t, n)
 		assert.Equal(t, version, "0.3.1")
 	})
+	t.Run("Node name", func(t *testing.T) {
+		//Only ADD records the node name
+		os.Remove(nodeStatePath)
+		_, err, _ := GenerateCentralIPM(cmdArgs("pod1", validNodeData))
+		assert.NoError(t, err)
+		_, err = os.Stat(nodeStatePath)
+		assert.True(t, os.IsNotExist(err))
+
+		assert.NoError(t, TrackNodeNames(cmdArgs("pod1", validNodeData)))
+		_, err = os.Stat(nodeStatePath)
+		assert.NoError(t, err)
+	})
 	t.Run("Cluster instance", func(t *testing.T) {
-		n, err, version := GenerateCentralIPM(&validClusterData)
+		n, err, version := GenerateCentralIPM(cmdArgs("pod1", validClusterData))
 		assert.NoError(t, err)
 		assert.NotNil(t, n)
 		assert.Equal(t, version, "0.3.1")
 	})
+	t.Run("Namespace instance", func(t *testing.T) {
+		args := cmdArgs("pod1", validNamespaceData)
+		_, err, _ := GenerateCentralIPM(args)
+		assert.Error(t, err)
+
+		args.Args = "IgnoreUnknown=1;K8S_POD_NAMESPACE=tenant-a;K8S_POD_NAME=pod1;K8S_POD_INFRA_CONTAINER_ID=pod1"
+		n, err, _ := GenerateCentralIPM(args)
+		assert.NoError(t, err)
+		ip, _, err := n[0].GetAvailableIP()
+		assert.NoError(t, err)
+		assert.Equal(t, "10.247.5.2", ip)
+	})
 }
 
-func TestGenerateInvalidCentralIPM(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
+const validRenameData = `
+	{
+		"name":"rename",
+		"cniVersion":"0.3.1",
+		"ipam":{
+			"type":"central",
+			"ipType": "node",
+			"network":"10.248.0.0/16",
+			"subnetLen": 24,
+			"subnetMin": "10.248.5.0",
+			"subnetMax": "10.248.6.0",
+			"nodeName": "%s",
+			"etcdURL": "%s"
+		}
+	}
+	`
+
+func TestRenameThenDel(t *testing.T) {
+	os.Remove(nodeStatePath)
+	defer os.Remove(nodeStatePath)
+	args := func(name string) *skel.CmdArgs {
+		return cmdArgs("pod1", strings.Replace(validRenameData, `"nodeName": "%s"`, `"nodeName": "`+name+`"`, 1))
+	}
+	_, families, err := LoadIPMConfigs(args("node-a").StdinData)
+	assert.NoError(t, err)
+	kv, err := utils.Connect(families[0])
+	assert.NoError(t, err)
+	defer kv.Close()
+	assert.NoError(t, kv.DeletePrefix(families[0].KeyPrefix()))
+
+	assert.NoError(t, TrackNodeNames(args("node-a")))
+	n, err, _ := GenerateCentralIPM(args("node-a"))
+	assert.NoError(t, err)
+	ip, _, err := n[0].GetAvailableIP()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.248.5.2", ip)
+
+	//The node is renamed, and a DEL comes before the next ADD
+	n, err, _ = GenerateCentralIPM(args("node-b"))
+	assert.NoError(t, err)
+	assert.NoError(t, n[0].Delete())
+	used, err := utils.UsedIPs(kv, families[0])
+	assert.NoError(t, err)
+	assert.Empty(t, used)
+	subnets, err := utils.NodeSubnets(kv, families[0])
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"node-a": "10.248.5.0/24"}, subnets)
+
+	assert.NoError(t, TrackNodeNames(args("node-b")))
+	subnets, err = utils.NodeSubnets(kv, families[0])
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"node-b": "10.248.5.0/24"}, subnets)
+}
+
+func TestGenerateReservedNameCentralIPM(t *testing.T) {
+	args := skel.CmdArgs{
+		StdinData: []byte(`{"name":"node","ipam":{"ipType":"cluster","network":"10.245.0.0/16"}}`),
 	}
-	n, err, _ := GenerateCentralIPM(&InvalidData)
+	n, err, _ := GenerateCentralIPM(&args)
+	assert.Error(t, err)
+	assert.Nil(t, n)
+}
+
+func TestLoadRoutesAndDNS(t *testing.T) {
+	data := []byte(`
+	{
+		"name":"mynet",
+		"ipam":{
+			"ipType": "node",
+			"network":"10.245.0.0/16",
+			"routes": [{"dst": "0.0.0.0/0"}],
+			"dns": {"nameservers": ["10.245.0.10"], "search": ["cluster.local"]},
+			"clusterRoute": true,
+			"ipv6": {
+				"network":"fd00:245::/48",
+				"routes": [{"dst": "::/0"}]
+			}
+		}
+	}`)
+	n, families, err := LoadIPMConfigs(data)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.245.0.10"}, n.IPM.DNS.Nameservers)
+	assert.Equal(t, 2, len(families))
+	assert.Equal(t, "0.0.0.0/0", families[0].Routes[0].Dst.String())
+	assert.Equal(t, "::/0", families[1].Routes[0].Dst.String())
+	assert.True(t, families[1].ClusterRoute)
+}
+
+func TestGenerateDualStackCentralIPM(t *testing.T) {
+	n, err, _ := GenerateCentralIPM(cmdArgs("pod1", validDualStackData))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(n))
+
+	_, v4, err := n[0].GetAvailableIP()
+	assert.NoError(t, err)
+	assert.NotNil(t, v4.IP.To4())
+
+	_, v6, err := n[1].GetAvailableIP()
+	assert.NoError(t, err)
+	assert.Nil(t, v6.IP.To4())
+}
+
+func TestGenerateInvalidCentralIPM(t *testing.T) {
+	n, err, _ := GenerateCentralIPM(cmdArgs("pod1", InvalidData))
 	assert.Error(t, err)
 	assert.Nil(t, n)
 }
+
+func TestConcurrentAdd(t *testing.T) {
+	const pods = 20
+	var wg sync.WaitGroup
+	ips := make(chan string, pods)
+	for i := 0; i < pods; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err, _ := GenerateCentralIPM(cmdArgs(fmt.Sprintf("concurrent%d", i), validConcurrentData))
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, ipNet, err := n[0].GetAvailableIP()
+			if assert.NoError(t, err) {
+				ips <- ipNet.IP.String()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(ips)
+
+	seen := make(map[string]bool)
+	for ip := range ips {
+		assert.False(t, seen[ip], "%s allocated twice", ip)
+		seen[ip] = true
+	}
+	assert.Equal(t, pods, len(seen))
+}
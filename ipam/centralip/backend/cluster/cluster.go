@@ -16,28 +16,35 @@ package cluster
 
 import (
 	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
 	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
-	"github.com/coreos/etcd/clientv3"
-	"math/rand"
+	"github.com/containernetworking/cni/pkg/types"
 	"net"
+	"strings"
 )
 
 type NodeIPM struct {
-	cli     *clientv3.Client
-	podname string
-	subnet  *net.IPNet
-	config  *utils.IPMConfig
+	kv            store.KV
+	hostname      string
+	podname       string
+	ifname        string
+	subnet        *net.IPNet
+	config        *utils.IPMConfig
+	clusterPrefix string
+	lease         store.LeaseID
+	exclude       []*net.IPNet
 }
 
-const clusterPrefix string = utils.ETCDPrefix + "cluster/"
-
-func New(podName string, config *utils.IPMConfig) (*NodeIPM, error) {
+func New(podName, ifName, hostname string, config *utils.IPMConfig) (*NodeIPM, error) {
 	node := &NodeIPM{}
 	node.config = config
 	var err error
 
+	node.hostname = hostname
 	node.podname = podName
-	node.cli, err = utils.ConnectETCD(config)
+	node.ifname = ifName
+	node.clusterPrefix = config.KeyPrefix() + "cluster/"
+	node.kv, err = utils.Connect(config)
 	if err != nil {
 		return nil, err
 	}
@@ -46,11 +53,52 @@ func New(podName string, config *utils.IPMConfig) (*NodeIPM, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	node.exclude, err = config.ValidateRange()
+	if err != nil {
+		return nil, err
+	}
+
+	err = utils.MigrateOnce(node.kv, config, node.migrate)
+	if err != nil {
+		return nil, err
+	}
+
+	//The IPs are allocated under the lease of the node, if any
+	node.lease, err = utils.NodeLease(node.kv, config, hostname)
+	if err != nil {
+		return nil, err
+	}
 	return node, nil
 }
 
+// migrate moves the IPs of this network from the unscoped keys into the
+// keys of the network.
+func (node *NodeIPM) migrate() error {
+	legacyPrefix := node.config.LegacyKeyPrefix() + "cluster/"
+	legacy, err := utils.GetKeyValuesWithPrefix(node.kv, legacyPrefix)
+	if err != nil {
+		return err
+	}
+
+	moving := make(map[string]string)
+	for k, v := range legacy {
+		ip := net.ParseIP(strings.TrimPrefix(k, legacyPrefix+"used/"))
+		if ip != nil && node.subnet.Contains(ip) {
+			moving[k] = v
+		}
+	}
+	return utils.MoveKeys(node.kv, moving, legacyPrefix, node.clusterPrefix)
+}
+
+// GetGateway returns the configured gateway. Without one, the pods are
+// left to the SDN controller for routing.
 func (node *NodeIPM) GetGateway() (string, error) {
-	return "", nil
+	return node.config.Gateway, nil
+}
+
+func (node *NodeIPM) GetRoutes() ([]*types.Route, error) {
+	return node.config.Routes, nil
 }
 
 func (node *NodeIPM) GetAvailableIP() (string, *net.IPNet, error) {
@@ -59,64 +107,37 @@ func (node *NodeIPM) GetAvailableIP() (string, *net.IPNet, error) {
 		return "", ipnet, fmt.Errorf("You should init IPM first")
 	}
 
-	usedIPPrefix := clusterPrefix + "used/"
-
-	length, _ := node.subnet.Mask.Size()
-	ipRange := utils.PowTwo(32 - (length))
-	//Since the first IP is gateway, we should skip it
-
-	//change to random a ip (must not be gateway) and try to check the etcd:
-	start := utils.GetNextIP(node.subnet)
-
-	//If ip Range = 256, our target it 2~255
-	//rand.Intn( range - 2 ) will return 0<=n<254,
-	//+2 will cause 2<=n<256
-	retryTimes := 20
-	var availableIP string
-	for i := 0; i < retryTimes; i++ {
-		tryIP := utils.GetIPByInt(start, uint32(rand.Intn(int(ipRange-2))+1))
-
-		ipUsedToPod, err := utils.GetKeyValuesWithPrefix(node.cli,usedIPPrefix)
-		if err != nil {
-			return "", ipnet, err
-		}
-
-		//check.
-		if _, ok := ipUsedToPod[usedIPPrefix+tryIP.String()]; !ok {
-			availableIP = tryIP.String()
-			utils.PutValue(node.cli, usedIPPrefix+tryIP.String(), node.podname)
-			break
-		}
+	//Without a configured gateway, the first IP is kept for the SDN
+	//controller, so we should skip it
+	gwIP := utils.GetNextIP(node.subnet)
+	if node.config.Gateway != "" {
+		gwIP = net.ParseIP(node.config.Gateway)
 	}
 
-	var err error
-	//We need to generate a net.IPnet object which contains the IP and Mask.
-	//We use ParseCIDR to create the net.IPnet object and assign IP back to it.
-	cidr := fmt.Sprintf("%s/%d", availableIP, length)
-	var ip net.IP
-	ip, ipnet, err = net.ParseCIDR(cidr)
+	allocator := utils.NewAllocator(node.kv, node.subnet, node.clusterPrefix, gwIP).
+		WithOptions(utils.LeaseOpts(node.config, node.lease)...).
+		WithRange(net.ParseIP(node.config.RangeStart), net.ParseIP(node.config.RangeEnd)).
+		WithExclude(node.exclude...)
+	ipnet, err := allocator.Allocate(node.owner())
 	if err != nil {
-		return "", ipnet, err
+		utils.RecordFailure(node.kv, node.config, node.hostname)
+		return "", ipnet, fmt.Errorf("Failed to allocate an IP in %s: %v", node.subnet, err)
 	}
+	return ipnet.IP.String(), ipnet, nil
+}
 
-	ipnet.IP = ip
-	return availableIP, ipnet, nil
+// Check verifies that ip is still allocated to this container
+func (node *NodeIPM) Check(ip net.IP) error {
+	allocator := utils.NewAllocator(node.kv, node.subnet, node.clusterPrefix)
+	return allocator.Check(node.owner(), ip)
 }
 
-func (node *NodeIPM) Delete() error {
-	//get all used ip address and try to matches it id.
-	usedIPPrefix := clusterPrefix + "used/"
-	ipUsedToPod, err := utils.GetKeyValuesWithPrefix(node.cli,usedIPPrefix)
-	if err != nil {
-		return err
-	}
+func (node *NodeIPM) owner() utils.Allocation {
+	return node.config.Owner(node.podname, node.ifname, node.hostname)
+}
 
-	for k, v := range ipUsedToPod {
-		fmt.Println(k, v)
-		if v == node.podname {
-			err := utils.DeleteKey(node.cli, k)
-			return err
-		}
-	}
-	return fmt.Errorf("There aren't any infomation about pod %s", node.podname)
+func (node *NodeIPM) Delete() error {
+	allocator := utils.NewAllocator(node.kv, node.subnet, node.clusterPrefix).
+		WithHold(node.config.StickyHoldTime)
+	return allocator.Release(node.owner())
 }
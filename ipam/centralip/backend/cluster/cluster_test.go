@@ -15,9 +15,12 @@
 package cluster
 
 import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/etcdtest"
 	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -27,35 +30,26 @@ var err error
 
 var validData = utils.IPMConfig{
 	Network: "10.123.0.0/16",
-	ETCDURL: "127.0.0.1:2379",
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(etcdtest.Main(m, &validData.ETCDURL))
 }
 
 func TestNewNode(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
-	}
-	node, err = New("pod1", &validData)
+	node, err = New("pod1", "eth0", "host1", &validData)
 	assert.NoError(t, err)
 	assert.NotNil(t, node)
-	assert.Equal(t, node.config.ETCDURL, "127.0.0.1:2379")
+	assert.Equal(t, node.config.ETCDURL, validData.ETCDURL)
 }
 
 func TestGetGateway(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
-	}
 	gwIP, err := node.GetGateway()
 	assert.NoError(t, err)
 	assert.Equal(t, "", gwIP)
 }
 
 func TestGetAvailableIP(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
-	}
 	t.Run("First IP", func(t *testing.T) {
 		ip, ipNet, err := node.GetAvailableIP()
 		assert.NoError(t, err)
@@ -84,11 +78,7 @@ func TestGetAvailableIP(t *testing.T) {
 }
 
 func TestSecondHost(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
-	}
-	node2, err := New("pod2", &validData)
+	node2, err := New("pod2", "eth0", "host1", &validData)
 	assert.NoError(t, err)
 
 	gwIP, err := node2.GetGateway()
@@ -101,29 +91,123 @@ func TestSecondHost(t *testing.T) {
 
 }
 
-func TestGenerateCentralIPMInvalid(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
+func TestConfiguredGateway(t *testing.T) {
+	var gatewayData = utils.IPMConfig{
+		Network:    "10.125.0.0/24",
+		ETCDURL:    validData.ETCDURL,
+		Name:       "gateway",
+		Gateway:    "10.125.0.254",
+		RangeStart: "10.125.0.250",
+		Exclude:    []string{"10.125.0.251"},
+	}
+	kv, err := utils.Connect(&gatewayData)
+	assert.NoError(t, err)
+	defer kv.Close()
+	err = kv.DeletePrefix(utils.ETCDPrefix + "gateway/")
+	assert.NoError(t, err)
+
+	n, err := New("pod1", "eth0", "host1", &gatewayData)
+	assert.NoError(t, err)
+	gwIP, err := n.GetGateway()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.125.0.254", gwIP)
+
+	var ips []string
+	for i := 0; i < 3; i++ {
+		n, err := New(fmt.Sprintf("pod%d", i), "eth0", "host1", &gatewayData)
+		assert.NoError(t, err)
+		ip, _, err := n.GetAvailableIP()
+		assert.NoError(t, err)
+		ips = append(ips, ip)
+	}
+	assert.Equal(t, []string{"10.125.0.250", "10.125.0.252", "10.125.0.253"}, ips)
+
+	n, err = New("pod3", "eth0", "host1", &gatewayData)
+	assert.NoError(t, err)
+	_, _, err = n.GetAvailableIP()
+	assert.Error(t, err)
+}
+
+func TestConcurrentAllocation(t *testing.T) {
+	var concurrentData = utils.IPMConfig{
+		Network: "10.124.0.0/24",
+		ETCDURL: validData.ETCDURL,
+		Name:    "concurrent",
+	}
+
+	var wg sync.WaitGroup
+	ips := make([]string, 16)
+	errs := make([]error, len(ips))
+	for i := range ips {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := New(fmt.Sprintf("pod%d", i), "eth0", "host1", &concurrentData)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			ips[i], _, errs[i] = n.GetAvailableIP()
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i, ip := range ips {
+		assert.NoError(t, errs[i])
+		assert.False(t, seen[ip], "%s was allocated twice", ip)
+		seen[ip] = true
 	}
+}
+
+func TestMigrateUnscopedKeys(t *testing.T) {
+	var scopedData = utils.IPMConfig{
+		Network: "10.127.0.0/16",
+		ETCDURL: validData.ETCDURL,
+		Name:    "migrate-cluster",
+	}
+	kv, err := utils.Connect(&scopedData)
+	assert.NoError(t, err)
+	defer kv.Close()
+	err = kv.DeletePrefix(utils.ETCDPrefix + "migrate-cluster/")
+	assert.NoError(t, err)
+
+	legacyPrefix := utils.ETCDPrefix + "cluster/used/"
+	assert.NoError(t, utils.PutValue(kv, legacyPrefix+"10.127.0.9", "pod9"))
+	assert.NoError(t, utils.PutValue(kv, legacyPrefix+"10.128.0.9", "other"))
+
+	_, err = New("pod1", "eth0", "host1", &scopedData)
+	assert.NoError(t, err)
+
+	keyValues, err := utils.GetKeyValuesWithPrefix(kv, utils.ETCDPrefix+"migrate-cluster/cluster/used/")
+	assert.NoError(t, err)
+	assert.Equal(t, "pod9", keyValues[utils.ETCDPrefix+"migrate-cluster/cluster/used/10.127.0.9"])
+
+	keyValues, err = utils.GetKeyValuesWithPrefix(kv, legacyPrefix)
+	assert.NoError(t, err)
+	assert.NotContains(t, keyValues, legacyPrefix+"10.127.0.9")
+	assert.Equal(t, "other", keyValues[legacyPrefix+"10.128.0.9"])
+}
+
+func TestGenerateCentralIPMInvalid(t *testing.T) {
 	t.Run("invalid etcd", func(t *testing.T) {
 		var InvalidETCD = utils.IPMConfig{
 			Network: "10.123.0.0/16",
 			ETCDURL: "127.0.0.1:23792",
 		}
 		var err error
-		node, err = New("pod1", &InvalidETCD)
+		node, err = New("pod1", "eth0", "host1", &InvalidETCD)
 		assert.Error(t, err)
 		assert.Nil(t, node)
 	})
 	t.Run("invalid network", func(t *testing.T) {
 		var InvalidNetwork = utils.IPMConfig{
 			Network: "10.23.0.0/16ds",
-			ETCDURL: "127.0.0.1:2379",
+			ETCDURL: validData.ETCDURL,
 		}
 
 		var err error
-		node, err = New("pod1", &InvalidNetwork)
+		node, err = New("pod1", "eth0", "host1", &InvalidNetwork)
 		assert.Error(t, err)
 		assert.Nil(t, node)
 	})
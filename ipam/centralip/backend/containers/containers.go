@@ -0,0 +1,227 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package containers lists the containers still running, so the
+// allocations of the others can be reconciled.
+package containers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	// networkStatus is set by multus with the IPs of every network of a pod
+	networkStatus       = "k8s.v1.cni.cncf.io/network-status"
+	legacyNetworkStatus = "k8s.v1.cni.cncf.io/networks-status"
+	requestTimeout      = 30 * time.Second
+)
+
+// Source lists what is alive
+type Source interface {
+	Live() (*utils.Live, error)
+}
+
+// FileSource reads the live container IDs from a file, one per line
+type FileSource struct {
+	Path string
+}
+
+func (s *FileSource) Live() (*utils.Live, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	live := utils.NewLive()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id != "" && !strings.HasPrefix(id, "#") {
+			live.ContainerIDs[id] = true
+		}
+	}
+	return live, scanner.Err()
+}
+
+// CRISource lists the pod sandboxes of a CRI runtime with crictl. The
+// sandbox ID is the container ID the runtime gives to CNI.
+type CRISource struct {
+	// Endpoint is the CRI socket, such as unix:///run/containerd/containerd.sock
+	Endpoint string
+	// Run runs a command and returns its output, exec by default
+	Run func(name string, args ...string) ([]byte, error)
+}
+
+func (s *CRISource) Live() (*utils.Live, error) {
+	run := s.Run
+	if run == nil {
+		run = func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).Output()
+		}
+	}
+
+	args := []string{"pods", "-q"}
+	if s.Endpoint != "" {
+		args = append([]string{"--runtime-endpoint", s.Endpoint}, args...)
+	}
+	output, err := run("crictl", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the pods with crictl: %v", err)
+	}
+
+	live := utils.NewLive()
+	for _, id := range strings.Fields(string(output)) {
+		live.ContainerIDs[id] = true
+	}
+	return live, nil
+}
+
+// KubernetesSource lists the IPs of the pods from the Kubernetes API. The
+// API doesn't know the sandbox IDs, so the allocations are matched by IP,
+// using the network-status annotation of multus for the IPs of the
+// secondary networks.
+type KubernetesSource struct {
+	// Server is the URL of the API server
+	Server string
+	Token  string
+	// Node limits the list to the pods of a node, empty for all the pods
+	Node   string
+	Client *http.Client
+}
+
+// NewInClusterSource returns a KubernetesSource using the service account
+// of the pod it runs in
+func NewInClusterSource(node string) (*KubernetesSource, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are unset")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %sca.crt", serviceAccountDir)
+	}
+
+	return &KubernetesSource{
+		Server: "https://" + net.JoinHostPort(host, port),
+		Token:  strings.TrimSpace(string(token)),
+		Node:   node,
+		Client: &http.Client{
+			Timeout:   requestTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Status struct {
+			Phase  string `json:"phase"`
+			PodIP  string `json:"podIP"`
+			PodIPs []struct {
+				IP string `json:"ip"`
+			} `json:"podIPs"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type networkStatusEntry struct {
+	IPs []string `json:"ips"`
+}
+
+func (s *KubernetesSource) Live() (*utils.Live, error) {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: requestTimeout}
+	}
+
+	u := strings.TrimSuffix(s.Server, "/") + "/api/v1/pods"
+	if s.Node != "" {
+		u += "?fieldSelector=" + url.QueryEscape("spec.nodeName="+s.Node)
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list the pods: %s", resp.Status)
+	}
+
+	var pods podList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("failed to decode the pods: %v", err)
+	}
+
+	live := utils.NewLive()
+	for _, pod := range pods.Items {
+		//The sandbox of a finished pod is torn down, with its IPs
+		if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		ips := []string{pod.Status.PodIP}
+		for _, podIP := range pod.Status.PodIPs {
+			ips = append(ips, podIP.IP)
+		}
+		for _, key := range []string{networkStatus, legacyNetworkStatus} {
+			var statuses []networkStatusEntry
+			if err := json.Unmarshal([]byte(pod.Metadata.Annotations[key]), &statuses); err != nil {
+				continue
+			}
+			for _, status := range statuses {
+				ips = append(ips, status.IPs...)
+			}
+		}
+
+		for _, ip := range ips {
+			//Normalize the IPv6 addresses, so they match the store
+			if parsed := net.ParseIP(ip); parsed != nil {
+				live.IPs[parsed.String()] = true
+			}
+		}
+	}
+	return live, nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package containers
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "live")
+	err = ioutil.WriteFile(path, []byte("# running on node1\nabc\n\n  def  \n"), 0644)
+	assert.NoError(t, err)
+
+	live, err := (&FileSource{Path: path}).Live()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"abc": true, "def": true}, live.ContainerIDs)
+
+	_, err = (&FileSource{Path: filepath.Join(dir, "missing")}).Live()
+	assert.Error(t, err)
+}
+
+func TestCRISource(t *testing.T) {
+	var called []string
+	source := &CRISource{
+		Endpoint: "unix:///run/containerd/containerd.sock",
+		Run: func(name string, args ...string) ([]byte, error) {
+			called = append([]string{name}, args...)
+			return []byte("abc\ndef\n"), nil
+		},
+	}
+	live, err := source.Live()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"crictl", "--runtime-endpoint", "unix:///run/containerd/containerd.sock", "pods", "-q"}, called)
+	assert.Equal(t, map[string]bool{"abc": true, "def": true}, live.ContainerIDs)
+
+	source.Run = func(name string, args ...string) ([]byte, error) {
+		return nil, fmt.Errorf("no such file")
+	}
+	_, err = source.Live()
+	assert.Error(t, err)
+}
+
+const pods = `{"items": [
+	{"metadata": {"annotations": {"k8s.v1.cni.cncf.io/network-status": "[{\"name\":\"ovs\",\"ips\":[\"10.245.5.2\",\"fd00:245:0:5:0:0:0:2\"]}]"}},
+	 "status": {"phase": "Running", "podIP": "10.244.1.2", "podIPs": [{"ip": "10.244.1.2"}]}},
+	{"metadata": {"annotations": {"k8s.v1.cni.cncf.io/networks-status": "[{\"name\":\"ovs\",\"ips\":[\"10.245.5.3\"]}]"}},
+	 "status": {"phase": "Pending"}},
+	{"metadata": {"annotations": {"k8s.v1.cni.cncf.io/network-status": "[{\"name\":\"ovs\",\"ips\":[\"10.245.5.4\"]}]"}},
+	 "status": {"phase": "Succeeded", "podIP": "10.244.1.4"}}
+]}`
+
+func TestKubernetesSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "/api/v1/pods", r.URL.Path)
+		assert.Equal(t, "spec.nodeName=node1", r.URL.Query().Get("fieldSelector"))
+		fmt.Fprint(w, pods)
+	}))
+	defer server.Close()
+
+	live, err := (&KubernetesSource{Server: server.URL, Token: "token", Node: "node1"}).Live()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"10.244.1.2":      true,
+		"10.245.5.2":      true,
+		"fd00:245:0:5::2": true,
+		"10.245.5.3":      true,
+	}, live.IPs)
+
+	_, err = (&KubernetesSource{Server: server.URL, Node: "node1"}).Live()
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcdtest runs an etcd server inside the test binary, so the
+// centralip tests don't need an etcd server on the machine.
+package etcdtest
+
+import (
+	"fmt"
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/pkg/capnslog"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+const startTimeout = 30 * time.Second
+
+func init() {
+	// etcd logs every raft step, which buries the output of the tests
+	capnslog.SetGlobalLogLevel(capnslog.WARNING)
+}
+
+// Server is an embedded etcd server listening on a random local port
+type Server struct {
+	etcd *embed.Etcd
+	dir  string
+}
+
+// Start starts a single member etcd server keeping its data in a temporary
+// directory
+func Start() (*Server, error) {
+	dir, err := ioutil.TempDir("", "etcdtest")
+	if err != nil {
+		return nil, err
+	}
+
+	// port 0 lets the kernel pick a free port, read back with URL
+	local, _ := url.Parse("http://127.0.0.1:0")
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LCUrls = []url.URL{*local}
+	cfg.ACUrls = []url.URL{*local}
+	cfg.LPUrls = []url.URL{*local}
+	cfg.APUrls = []url.URL{*local}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(startTimeout):
+		e.Close()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("etcd didn't start in %v", startTimeout)
+	}
+	return &Server{etcd: e, dir: dir}, nil
+}
+
+// URL is the client address of the server, in the form of the etcdURL option
+func (s *Server) URL() string {
+	return s.etcd.Clients[0].Addr().String()
+}
+
+// Stop shuts the server down and removes its data
+func (s *Server) Stop() {
+	s.etcd.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Main is meant to be called by TestMain. It starts a server, stores its
+// address in etcdURL, runs the tests and stops the server.
+func Main(m *testing.M, etcdURL *string) int {
+	s, err := Start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start etcd: %v\n", err)
+		return 1
+	}
+	defer s.Stop()
+
+	*etcdURL = s.URL()
+	return m.Run()
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package events turns the changes of the keys of a centralip network into
+// a stream of allocation and subnet events, for controllers that need to
+// know which IP lives on which node.
+package events
+
+import (
+	"context"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"strings"
+)
+
+// Version is the version of the Event documents. It changes when a field
+// changes meaning, not when one is added.
+const Version = 1
+
+// The types of events
+const (
+	// Allocated is sent when an IP is given to a container
+	Allocated = "allocated"
+	// Released is sent when an IP is freed, or held for its pod once its
+	// container is gone
+	Released = "released"
+	// SubnetRegistered is sent when a node or namespace gets its subnet
+	SubnetRegistered = "subnet-registered"
+	// SubnetReleased is sent when a node or namespace loses its subnet
+	SubnetReleased = "subnet-released"
+	// Synced ends the snapshot of the network
+	Synced = "synced"
+	// Compacted ends a stream whose revision the store no longer knows.
+	// The consumer has to start over from a snapshot.
+	Compacted = "compacted"
+)
+
+// Event is a change of an IP or subnet of a network. Revision is the store
+// revision of the change, and watching from Revision+1 resumes after it.
+type Event struct {
+	Version  int    `json:"version"`
+	Revision int64  `json:"revision"`
+	Type     string `json:"type"`
+	// Network is the name of the network and CIDR the network of its IP
+	// family
+	Network string `json:"network,omitempty"`
+	CIDR    string `json:"cidr,omitempty"`
+
+	IP     string `json:"ip,omitempty"`
+	Subnet string `json:"subnet,omitempty"`
+	// Node runs the container owning the IP, or owns the subnet in the
+	// node mode. Namespace owns the subnet in the namespace mode.
+	Node      string `json:"node,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+
+	ContainerID string `json:"containerID,omitempty"`
+	IfName      string `json:"ifName,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	// Held marks a released IP kept for its pod
+	Held bool `json:"held,omitempty"`
+}
+
+// family returns the IP family of families holding key. The IPv6 keys live
+// under the prefix of the IPv4 ones.
+func family(families []*utils.IPMConfig, key string) *utils.IPMConfig {
+	for _, config := range families[1:] {
+		if strings.HasPrefix(key, config.KeyPrefix()) {
+			return config
+		}
+	}
+	return families[0]
+}
+
+// parse returns the event of a change of key, if key is an IP or the
+// subnet of a node or namespace
+func parse(config *utils.IPMConfig, kv store.KeyValue, deleted bool) (*Event, bool) {
+	rest := strings.TrimPrefix(kv.Key, config.KeyPrefix())
+	//namespace/names/<ns> is read as namespace/<ns>, beside the index in
+	//namespace/subnets/
+	if strings.HasPrefix(rest, "namespace/") {
+		if !strings.HasPrefix(rest, "namespace/names/") {
+			return nil, false
+		}
+		rest = "namespace/" + strings.TrimPrefix(rest, "namespace/names/")
+	}
+	parts := strings.Split(rest, "/")
+	event := &Event{Version: Version, Revision: kv.ModRevision, Network: config.Name, CIDR: config.Network}
+
+	switch {
+	//node/<host> and namespace/<ns> hold the subnet
+	case len(parts) == 2 && (parts[0] == "namespace" || (parts[0] == "node" && parts[1] != "subnets")):
+		event.Type = SubnetRegistered
+		if deleted {
+			event.Type = SubnetReleased
+		}
+		event.Subnet = kv.Value
+		if parts[0] == "node" {
+			event.Node = parts[1]
+		} else {
+			event.Namespace = parts[1]
+		}
+		return event, true
+
+	//cluster/used/<ip>, node/<host>/used/<ip> and namespace/<ns>/used/<ip>
+	//hold the owner of the IP
+	case len(parts) == 3 && parts[0] == "cluster" && parts[1] == "used",
+		len(parts) == 4 && (parts[0] == "node" || parts[0] == "namespace") && parts[2] == "used":
+		owner := utils.ParseAllocation(kv.Value)
+		event.Type = Allocated
+		if deleted || owner.Held {
+			event.Type = Released
+		}
+		event.IP = parts[len(parts)-1]
+		event.Node = owner.Node
+		if parts[0] == "node" && event.Node == "" {
+			event.Node = parts[1]
+		}
+		if parts[0] == "namespace" {
+			event.Namespace = parts[1]
+		}
+		event.ContainerID = owner.ContainerID
+		event.IfName = owner.IfName
+		event.Pod = owner.Pod
+		event.Held = owner.Held && !deleted
+		return event, true
+	}
+	return nil, false
+}
+
+// Snapshot returns an event for each IP and subnet of the network whose
+// IP families are families, as returned by IPMConfig.Families, and the
+// revision to watch from afterwards
+func Snapshot(kv store.KV, families []*utils.IPMConfig) ([]Event, int64, error) {
+	kvs, revision, err := kv.Range(families[0].KeyPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var events []Event
+	for _, keyValue := range kvs {
+		if event, ok := parse(family(families, keyValue.Key), keyValue, false); ok {
+			events = append(events, *event)
+		}
+	}
+	return events, revision + 1, nil
+}
+
+// Watch sends the events of the network from revision on, or from now if
+// revision is 0, until ctx is done. When the store no longer knows the
+// revision, a Compacted event ends the stream.
+func Watch(ctx context.Context, kv store.KV, families []*utils.IPMConfig, revision int64) <-chan Event {
+	events := make(chan Event)
+	changes := kv.Watch(ctx, families[0].KeyPrefix(), store.WithRevision(revision))
+	go func() {
+		defer close(events)
+		for change := range changes {
+			var event *Event
+			if change.Type == store.EventCompacted {
+				event = &Event{Version: Version, Revision: change.ModRevision, Type: Compacted}
+			} else {
+				var ok bool
+				event, ok = parse(family(families, change.Key), change.KeyValue, change.Type == store.EventDelete)
+				if !ok {
+					continue
+				}
+			}
+			select {
+			case events <- *event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/etcdtest"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var config = &utils.IPMConfig{
+	IPType:    "node",
+	Network:   "10.138.0.0/16",
+	SubnetLen: 24,
+	SubnetMin: "10.138.1.0",
+	SubnetMax: "10.138.9.0",
+	IPv6: &utils.IPMConfig{
+		Network:   "fd00:138::/48",
+		SubnetLen: 64,
+		SubnetMin: "fd00:138:0:1::",
+		SubnetMax: "fd00:138:0:9::",
+	},
+	Name: "events-test",
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(etcdtest.Main(m, &config.ETCDURL))
+}
+
+func next(t *testing.T, events <-chan Event) Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return Event{}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	families, err := config.Families()
+	assert.NoError(t, err)
+	v4, v6 := families[0].KeyPrefix(), families[1].KeyPrefix()
+	kv, err := utils.Connect(config)
+	assert.NoError(t, err)
+	defer kv.Close()
+	assert.NoError(t, kv.DeletePrefix(v4))
+
+	for k, v := range map[string]string{
+		v4 + "node/host1":                    "10.138.1.0/24",
+		v4 + "node/subnets/10.138.1.0/24":    "host1",
+		v4 + "node/host1/gateway":            "10.138.1.1",
+		v4 + "node/host1/used/10.138.1.2":    utils.Allocation{ContainerID: "c1", IfName: "eth0", Node: "host1"}.String(),
+		v4 + "node/host1/containers/c1/eth0": "10.138.1.2",
+		v6 + "node/host1":                    "fd00:138:0:1::/64",
+	} {
+		assert.NoError(t, utils.PutValue(kv, k, v))
+	}
+
+	snapshot, revision, err := Snapshot(kv, families)
+	assert.NoError(t, err)
+	assert.Len(t, snapshot, 3)
+	assert.Equal(t, "fd00:138::/48", snapshot[0].CIDR)
+	assert.Equal(t, "fd00:138:0:1::/64", snapshot[0].Subnet)
+	assert.Equal(t, SubnetRegistered, snapshot[1].Type)
+	assert.Equal(t, "10.138.1.0/24", snapshot[1].Subnet)
+	assert.Equal(t, Allocated, snapshot[2].Type)
+	assert.Equal(t, "10.138.1.2", snapshot[2].IP)
+	assert.Equal(t, "host1", snapshot[2].Node)
+	assert.Equal(t, "c1", snapshot[2].ContainerID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := Watch(ctx, kv, families, revision)
+
+	assert.NoError(t, kv.Delete(v4+"node/host1/used/10.138.1.2"))
+	released := next(t, events)
+	assert.Equal(t, Released, released.Type)
+	assert.Equal(t, "10.138.1.2", released.IP)
+	assert.Equal(t, "c1", released.ContainerID)
+	assert.Equal(t, Version, released.Version)
+
+	assert.NoError(t, kv.Delete(v4+"node/host1"))
+	subnet := next(t, events)
+	assert.Equal(t, SubnetReleased, subnet.Type)
+	assert.Equal(t, "host1", subnet.Node)
+	assert.Equal(t, "10.138.1.0/24", subnet.Subnet)
+
+	t.Run("resume", func(t *testing.T) {
+		resumed := Watch(ctx, kv, families, released.Revision+1)
+		assert.Equal(t, subnet, next(t, resumed))
+	})
+
+	t.Run("http", func(t *testing.T) {
+		server := httptest.NewServer(Handler(kv, families))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+
+		var streamed []Event
+		for scanner.Scan() {
+			event := Event{}
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			streamed = append(streamed, event)
+			if event.Type == Synced {
+				break
+			}
+		}
+		//Only the IPv6 subnet is left
+		assert.Len(t, streamed, 2)
+		assert.Equal(t, "fd00:138:0:1::/64", streamed[0].Subnet)
+
+		assert.NoError(t, utils.PutValue(kv, v4+"node/host2", "10.138.2.0/24"))
+		assert.True(t, scanner.Scan())
+		event := Event{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		assert.Equal(t, SubnetRegistered, event.Type)
+		assert.Equal(t, "host2", event.Node)
+
+		resp, err = http.Get(server.URL + "?revision=" + strconv.FormatInt(subnet.Revision, 10))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		scanner = bufio.NewScanner(resp.Body)
+		assert.True(t, scanner.Scan())
+		event = Event{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		assert.Equal(t, subnet, event)
+	})
+}
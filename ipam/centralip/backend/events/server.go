@@ -0,0 +1,73 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"encoding/json"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"net/http"
+	"strconv"
+)
+
+// Handler streams the events of the network as one JSON Event per line.
+// With ?revision=N the stream resumes at the revision N, otherwise it
+// starts with a snapshot of the network ended by a Synced event.
+func Handler(kv store.KV, families []*utils.IPMConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		var revision int64
+		if value := r.URL.Query().Get("revision"); value != "" {
+			var err error
+			revision, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || revision <= 0 {
+				http.Error(w, "invalid revision "+value, http.StatusBadRequest)
+				return
+			}
+		}
+
+		var snapshot []Event
+		if revision == 0 {
+			var err error
+			snapshot, revision, err = Snapshot(kv, families)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			snapshot = append(snapshot, Event{Version: Version, Revision: revision - 1, Type: Synced})
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, event := range snapshot {
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		for event := range Watch(r.Context(), kv, families, revision) {
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
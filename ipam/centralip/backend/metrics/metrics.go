@@ -0,0 +1,191 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exports the usage of the centralip pools to Prometheus.
+package metrics
+
+import (
+	"context"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"math/big"
+	"sync"
+)
+
+var (
+	addressesDesc = prometheus.NewDesc("centralip_addresses",
+		"Number of allocatable addresses of the subnet of a node or namespace, or of the whole network in the cluster mode.",
+		[]string{"network", "cidr", "node", "subnet"}, nil)
+	usedDesc = prometheus.NewDesc("centralip_addresses_used",
+		"Number of allocated addresses of the subnet of a node or namespace, or of the whole network in the cluster mode.",
+		[]string{"network", "cidr", "node", "subnet"}, nil)
+	nodeUsedDesc = prometheus.NewDesc("centralip_node_addresses_used",
+		"Number of addresses allocated to the containers of a node.",
+		[]string{"network", "cidr", "node"}, nil)
+	subnetsDesc = prometheus.NewDesc("centralip_subnets",
+		"Number of subnets in the subnet ranges, in the node and namespace modes.",
+		[]string{"network", "cidr"}, nil)
+	freeSubnetsDesc = prometheus.NewDesc("centralip_subnets_free",
+		"Number of subnets left in the subnet ranges, in the node and namespace modes.",
+		[]string{"network", "cidr"}, nil)
+	failuresDesc = prometheus.NewDesc("centralip_allocation_failures_total",
+		"Number of ADDs of a node that failed to get an address or a subnet.",
+		[]string{"network", "cidr", "node"}, nil)
+)
+
+// Network is one IP family of a centralip network and its store
+type Network struct {
+	KV     store.KV
+	Config *utils.IPMConfig
+}
+
+// Collector computes the metrics of the networks from their keys. Once
+// Watch runs, they are only computed again after the keys changed.
+type Collector struct {
+	networks []Network
+
+	mu       sync.Mutex
+	watching int
+	dirty    bool
+	metrics  []prometheus.Metric
+}
+
+// NewCollector returns a Collector of networks
+func NewCollector(networks []Network) *Collector {
+	return &Collector{networks: networks, dirty: true}
+}
+
+// Watch marks the metrics stale whenever the keys of a network change,
+// until ctx is done. Without it the metrics are computed on each scrape.
+func (c *Collector) Watch(ctx context.Context) {
+	c.mu.Lock()
+	c.watching = len(c.networks)
+	c.dirty = true
+	c.mu.Unlock()
+
+	for _, n := range c.networks {
+		events := n.KV.Watch(ctx, n.Config.KeyPrefix())
+		go func() {
+			for range events {
+				c.mu.Lock()
+				c.dirty = true
+				c.mu.Unlock()
+			}
+			//The watch ended, so fall back to computing on each scrape
+			c.mu.Lock()
+			c.watching--
+			c.mu.Unlock()
+		}()
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{addressesDesc, usedDesc, nodeUsedDesc, subnetsDesc, freeSubnetsDesc, failuresDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dirty || c.watching < len(c.networks) {
+		//Changes made while computing mark the metrics stale again
+		c.dirty = false
+		c.mu.Unlock()
+		metrics, err := c.compute()
+		c.mu.Lock()
+		if err != nil {
+			c.dirty = true
+			ch <- prometheus.NewInvalidMetric(usedDesc, err)
+			return
+		}
+		c.metrics = metrics
+	}
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
+
+func (c *Collector) compute() ([]prometheus.Metric, error) {
+	var metrics []prometheus.Metric
+	for _, n := range c.networks {
+		m, err := networkMetrics(n.KV, n.Config)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m...)
+	}
+	return metrics, nil
+}
+
+func bigFloat(n *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return f
+}
+
+func networkMetrics(kv store.KV, config *utils.IPMConfig) ([]prometheus.Metric, error) {
+	var metrics []prometheus.Metric
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		labels = append([]string{config.Name, config.Network}, labels...)
+		metrics = append(metrics, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...))
+	}
+
+	usages, err := utils.PoolUsage(kv, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range usages {
+		gauge(addressesDesc, bigFloat(u.Size), u.Node, u.Subnet.String())
+		gauge(usedDesc, float64(u.Used), u.Node, u.Subnet.String())
+	}
+
+	ips, err := utils.UsedIPs(kv, config)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]int)
+	for _, used := range ips {
+		nodes[used.Owner.Node]++
+	}
+	for node, used := range nodes {
+		gauge(nodeUsedDesc, float64(used), node)
+	}
+
+	if config.IPType == "node" || config.IPType == "namespace" {
+		count, err := utils.SubnetCount(config)
+		if err != nil {
+			return nil, err
+		}
+		free := new(big.Int).Sub(count, big.NewInt(int64(len(usages))))
+		if free.Sign() < 0 {
+			free.SetInt64(0)
+		}
+		gauge(subnetsDesc, bigFloat(count))
+		gauge(freeSubnetsDesc, bigFloat(free))
+	}
+
+	failures, err := utils.Failures(kv, config)
+	if err != nil {
+		return nil, err
+	}
+	for node, count := range failures {
+		metrics = append(metrics, prometheus.MustNewConstMetric(failuresDesc, prometheus.CounterValue,
+			float64(count), config.Name, config.Network, node))
+	}
+	return metrics, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gather returns the value of each metric, keyed by its name and labels
+func gather(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, label := range m.GetLabel() {
+				if label.GetName() != "network" && label.GetName() != "cidr" {
+					labels = append(labels, label.GetName()+"="+label.GetValue())
+				}
+			}
+			value := m.GetGauge().GetValue()
+			if m.GetCounter() != nil {
+				value = m.GetCounter().GetValue()
+			}
+			values[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = value
+		}
+	}
+	return values
+}
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centralip")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &utils.IPMConfig{
+		IPType:    "node",
+		Network:   "10.137.0.0/16",
+		SubnetLen: 24,
+		SubnetMin: "10.137.1.0",
+		SubnetMax: "10.137.4.0",
+		Store:     "file",
+		StorePath: filepath.Join(dir, "store.json"),
+		Name:      "metrics-test",
+	}
+	kv, err := utils.Connect(config)
+	assert.NoError(t, err)
+	defer kv.Close()
+
+	prefix := config.KeyPrefix() + "node/"
+	for k, v := range map[string]string{
+		"host1":                    "10.137.1.0/24",
+		"subnets/10.137.1.0/24":    "host1",
+		"host1/used/10.137.1.2":    utils.Allocation{ContainerID: "c1", IfName: "eth0", Node: "host1"}.String(),
+		"host1/used/10.137.1.3":    utils.Allocation{ContainerID: "c2", IfName: "eth0", Node: "host1"}.String(),
+		"host2":                    "10.137.2.0/24",
+		"subnets/10.137.2.0/24":    "host2",
+		"host2/used/10.137.2.2":    utils.Allocation{ContainerID: "c3", IfName: "eth0", Node: "host2"}.String(),
+		"host1/containers/c1/eth0": "10.137.1.2",
+		"host1/containers/c2/eth0": "10.137.1.3",
+		"host2/containers/c3/eth0": "10.137.2.2",
+	} {
+		assert.NoError(t, utils.PutValue(kv, prefix+k, v))
+	}
+	assert.NoError(t, utils.RecordFailure(kv, config, "host2"))
+	assert.NoError(t, utils.RecordFailure(kv, config, "host2"))
+
+	collector := NewCollector([]Network{{KV: kv, Config: config}})
+	registry := prometheus.NewRegistry()
+	assert.NoError(t, registry.Register(collector))
+
+	values := gather(t, registry)
+	assert.Equal(t, 253.0, values["centralip_addresses{node=host1,subnet=10.137.1.0/24}"])
+	assert.Equal(t, 2.0, values["centralip_addresses_used{node=host1,subnet=10.137.1.0/24}"])
+	assert.Equal(t, 1.0, values["centralip_addresses_used{node=host2,subnet=10.137.2.0/24}"])
+	assert.Equal(t, 2.0, values["centralip_node_addresses_used{node=host1}"])
+	assert.Equal(t, 4.0, values["centralip_subnets{}"])
+	assert.Equal(t, 2.0, values["centralip_subnets_free{}"])
+	assert.Equal(t, 2.0, values["centralip_allocation_failures_total{node=host2}"])
+
+	t.Run("watch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		collector.Watch(ctx)
+		gather(t, registry)
+
+		assert.NoError(t, kv.Delete(prefix+"host2/used/10.137.2.2"))
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, ok := gather(t, registry)["centralip_node_addresses_used{node=host2}"]
+			if !ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the released IP is still counted")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, 0.0, gather(t, registry)["centralip_addresses_used{node=host2,subnet=10.137.2.0/24}"])
+	})
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package namespace
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/containernetworking/cni/pkg/types"
+	"net"
+	"strings"
+)
+
+// NamespaceIPM gives each Kubernetes namespace its own subnet, shared by
+// its pods on every node
+type NamespaceIPM struct {
+	kv              store.KV
+	hostname        string
+	podname         string
+	ifname          string
+	namespace       string
+	subnet          *net.IPNet
+	config          *utils.IPMConfig
+	namespacePrefix string
+	subnetPrefix    string
+	lease           store.LeaseID
+	exclude         []*net.IPNet
+}
+
+func New(podName, ifName, hostname, namespace string, config *utils.IPMConfig) (*NamespaceIPM, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("The namespace mode needs K8S_POD_NAMESPACE in CNI_ARGS")
+	}
+
+	ns := &NamespaceIPM{}
+	ns.config = config
+	var err error
+
+	ns.hostname = hostname
+	ns.podname = podName
+	ns.ifname = ifName
+	ns.namespace = namespace
+	//The names have their own level, so no namespace collides with the
+	//subnet index
+	ns.namespacePrefix = config.KeyPrefix() + "namespace/names/"
+	ns.subnetPrefix = config.KeyPrefix() + "namespace/subnets/"
+
+	ns.exclude, err = config.ValidateRange()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.ValidateSubnets(); err != nil {
+		return nil, err
+	}
+
+	ns.kv, err = utils.Connect(config)
+	if err != nil {
+		return nil, err
+	}
+
+	//The subnet outlives the nodes, so only the IPs are allocated under the
+	//lease of the node, if any
+	ns.lease, err = utils.NodeLease(ns.kv, config, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ns.registerNamespace()
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+func (ns *NamespaceIPM) checkNamespaceIsRegistered() error {
+	subnet, ok, err := utils.GetValue(ns.kv, ns.namespacePrefix+ns.namespace)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return nil
+	}
+
+	_, ns.subnet, err = net.ParseCIDR(subnet)
+	return err
+}
+
+func (ns *NamespaceIPM) registerNamespace() error {
+	err := ns.checkNamespaceIsRegistered()
+	if err != nil || ns.subnet != nil {
+		return err
+	}
+
+	for {
+		namespaceToSubnets, err := utils.GetKeyValuesWithPrefix(ns.kv, ns.subnetPrefix)
+		if err != nil {
+			return err
+		}
+
+		var registered []*net.IPNet
+		for k := range namespaceToSubnets {
+			if _, subnet, err := net.ParseCIDR(strings.TrimPrefix(k, ns.subnetPrefix)); err == nil {
+				registered = append(registered, subnet)
+			}
+		}
+		subnet, err := utils.NextSubnet(ns.config, registered)
+		if err != nil {
+			utils.RecordFailure(ns.kv, ns.config, ns.hostname)
+			return err
+		}
+
+		//store the $namespacePrefix/namespace -> subnet and
+		//the $subnetPrefix/$subnet -> namespace together, unless
+		//another namespace took the subnet in the meantime
+		ok, err := utils.PutValuesIfAbsent(ns.kv, map[string]string{
+			ns.namespacePrefix + ns.namespace: subnet.String(),
+			ns.subnetPrefix + subnet.String(): ns.namespace,
+		})
+		if err != nil {
+			return err
+		}
+		if ok {
+			ns.subnet = subnet
+			return nil
+		}
+
+		//A concurrent ADD in this namespace may have registered it already,
+		//otherwise another namespace registered a subnet, so look again
+		if err := ns.checkNamespaceIsRegistered(); err != nil {
+			return err
+		}
+		if ns.subnet != nil {
+			return nil
+		}
+	}
+}
+
+// GetGateway returns the first IP of the subnet of the namespace, or the
+// configured gateway if it belongs to that subnet
+func (ns *NamespaceIPM) GetGateway() (string, error) {
+	if ns.subnet == nil {
+		return "", fmt.Errorf("You should init IPM first")
+	}
+
+	if gw := net.ParseIP(ns.config.Gateway); gw != nil && ns.subnet.Contains(gw) {
+		return gw.String(), nil
+	}
+	return utils.GetNextIP(ns.subnet).String(), nil
+}
+
+// GetRoutes returns the configured routes, and the route to the other
+// namespaces through the gateway of this namespace if clusterRoute is set
+func (ns *NamespaceIPM) GetRoutes() ([]*types.Route, error) {
+	routes := append([]*types.Route{}, ns.config.Routes...)
+	if !ns.config.ClusterRoute {
+		return routes, nil
+	}
+
+	_, network, err := net.ParseCIDR(ns.config.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	gwIP, err := ns.GetGateway()
+	if err != nil {
+		return nil, err
+	}
+	return append(routes, &types.Route{Dst: *network, GW: net.ParseIP(gwIP)}), nil
+}
+
+func (ns *NamespaceIPM) allocator(reserved ...net.IP) *utils.Allocator {
+	return utils.NewAllocator(ns.kv, ns.subnet, ns.namespacePrefix+ns.namespace+"/", reserved...)
+}
+
+func (ns *NamespaceIPM) GetAvailableIP() (string, *net.IPNet, error) {
+	ipnet := &net.IPNet{}
+	if ns.subnet == nil {
+		return "", ipnet, fmt.Errorf("You should init IPM first")
+	}
+
+	gwIP, err := ns.GetGateway()
+	if err != nil {
+		return "", ipnet, err
+	}
+
+	allocator := ns.allocator(net.ParseIP(gwIP)).
+		WithOptions(utils.LeaseOpts(ns.config, ns.lease)...).
+		WithRange(net.ParseIP(ns.config.RangeStart), net.ParseIP(ns.config.RangeEnd)).
+		WithExclude(ns.exclude...)
+	ipnet, err = allocator.Allocate(ns.owner())
+	if err != nil {
+		utils.RecordFailure(ns.kv, ns.config, ns.hostname)
+		return "", ipnet, fmt.Errorf("Failed to allocate an IP in %s: %v", ns.subnet, err)
+	}
+	return ipnet.IP.String(), ipnet, nil
+}
+
+// Check verifies that ip is still allocated to this container, from the
+// subnet registered for its namespace
+func (ns *NamespaceIPM) Check(ip net.IP) error {
+	if !ns.subnet.Contains(ip) {
+		return fmt.Errorf("%s is not in the subnet %s of the namespace %s", ip, ns.subnet, ns.namespace)
+	}
+	return ns.allocator().Check(ns.owner(), ip)
+}
+
+func (ns *NamespaceIPM) owner() utils.Allocation {
+	return ns.config.Owner(ns.podname, ns.ifname, ns.hostname)
+}
+
+func (ns *NamespaceIPM) Delete() error {
+	return ns.allocator().WithHold(ns.config.StickyHoldTime).Release(ns.owner())
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package namespace
+
+import (
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/etcdtest"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+)
+
+var validData = utils.IPMConfig{
+	IPType:    "namespace",
+	Network:   "10.132.0.0/16",
+	SubnetLen: 24,
+	SubnetMin: "10.132.1.0",
+	SubnetMax: "10.132.2.0",
+	Name:      "namespace-test",
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(etcdtest.Main(m, &validData.ETCDURL))
+}
+
+func TestNamespace(t *testing.T) {
+	_, err := New("pod1", "eth0", "host1", "", &validData)
+	assert.Error(t, err)
+	ns, err := New("pod1", "eth0", "host1", "tenant-a", &validData)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.132.1.0/24", ns.subnet.String())
+
+	gwIP, err := ns.GetGateway()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.132.1.1", gwIP)
+	ip, ipNet, err := ns.GetAvailableIP()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.132.1.2", ip)
+	assert.Equal(t, "10.132.1.2/24", ipNet.String())
+
+	t.Run("same namespace on another node", func(t *testing.T) {
+		ns2, err := New("pod2", "eth0", "host2", "tenant-a", &validData)
+		assert.NoError(t, err)
+		ip, _, err := ns2.GetAvailableIP()
+		assert.NoError(t, err)
+		assert.Equal(t, "10.132.1.3", ip)
+		assert.NoError(t, ns2.Delete())
+	})
+
+	t.Run("another namespace", func(t *testing.T) {
+		//A namespace may be named like the subnet index
+		ns3, err := New("pod3", "eth0", "host1", "subnets", &validData)
+		assert.NoError(t, err)
+		ip, _, err := ns3.GetAvailableIP()
+		assert.NoError(t, err)
+		assert.Equal(t, "10.132.2.2", ip)
+		assert.Error(t, ns3.Check(net.ParseIP("10.132.1.2")))
+		subnets, err := utils.NodeSubnets(ns3.kv, &validData)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"tenant-a": "10.132.1.0/24", "subnets": "10.132.2.0/24"}, subnets)
+		problems, err := utils.CheckSubnets(ns3.kv, &validData)
+		assert.NoError(t, err)
+		assert.Empty(t, problems)
+
+		_, err = New("pod4", "eth0", "host1", "tenant-c", &validData)
+		assert.Error(t, err)
+	})
+
+	t.Run("check", func(t *testing.T) {
+		assert.NoError(t, ns.Check(net.ParseIP(ip)))
+		assert.NoError(t, ns.Delete())
+		assert.Error(t, ns.Check(net.ParseIP(ip)))
+	})
+}
@@ -16,111 +16,210 @@ package node
 
 import (
 	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
 	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
-	"github.com/coreos/etcd/clientv3"
-	"math/rand"
+	"github.com/containernetworking/cni/pkg/types"
 	"net"
+	"strings"
 )
 
 type NodeIPM struct {
-	cli      *clientv3.Client
-	hostname string
-	podname  string
-	subnet   *net.IPNet
-	config   *utils.IPMConfig
+	kv           store.KV
+	ipkv         store.KV
+	hostname     string
+	podname      string
+	ifname       string
+	subnet       *net.IPNet
+	config       *utils.IPMConfig
+	nodePrefix   string
+	subnetPrefix string
+	lease        store.LeaseID
+	exclude      []*net.IPNet
 }
 
-const nodePrefix string = utils.ETCDPrefix + "node/"
-const subnetPrefix string = nodePrefix + "subnets/"
-
-func New(podName, hostname string, config *utils.IPMConfig) (*NodeIPM, error) {
+func New(podName, ifName, hostname string, config *utils.IPMConfig) (*NodeIPM, error) {
 	node := &NodeIPM{}
 	node.config = config
 	var err error
 
 	node.hostname = hostname
 	node.podname = podName
+	node.ifname = ifName
+	node.nodePrefix = config.KeyPrefix() + "node/"
+	node.subnetPrefix = node.nodePrefix + "subnets/"
 
-	node.cli, err = utils.ConnectETCD(config)
+	node.exclude, err = config.ValidateRange()
 	if err != nil {
 		return nil, err
 	}
+	if err := config.ValidateSubnets(); err != nil {
+		return nil, err
+	}
 
-	err = node.registerNode()
+	//With localIPs the subnet is cached in the local store once registered,
+	//so allocating an IP doesn't need etcd
+	if config.LocalIPs {
+		node.ipkv, err = utils.ConnectLocal(config)
+		if err != nil {
+			return nil, err
+		}
+		err = node.checkNodeIsRegisted(node.ipkv)
+		if err != nil || node.subnet != nil {
+			return node, err
+		}
+	}
+
+	node.kv, err = utils.Connect(config)
 	if err != nil {
 		return nil, err
 	}
-	return node, nil
-}
 
-func (node *NodeIPM) checkNodeIsRegisted() error {
+	err = utils.MigrateOnce(node.kv, config, node.migrate)
+	if err != nil {
+		return nil, err
+	}
 
-	keyValues, err := utils.GetKeyValuesWithPrefix(node.cli,nodePrefix + node.hostname)
+	//Register the subnet under the lease of the node, if any
+	node.lease, err = utils.NodeLease(node.kv, config, hostname)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if 0 == len(keyValues) {
-		return nil
+	err = node.registerNode()
+	if err != nil {
+		return nil, err
 	}
 
-	_, node.subnet, err = net.ParseCIDR(keyValues[nodePrefix+node.hostname])
-	return err
+	if !config.LocalIPs {
+		node.ipkv = node.kv
+		return node, nil
+	}
+	err = node.cacheSubnet()
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
 }
 
-func (node *NodeIPM) registerSubnet() error {
-	//Convert the subnet to int. for example.
-	//string(10.16.7.0) -> net.IP(10.16.7.0) -> int(168822528)
-	ipnet := net.ParseIP(node.config.SubnetMin)
-	ipStart, err := utils.IpToInt(ipnet)
+// cacheSubnet stores the subnet of the node in the local store, and moves
+// there the IPs the node allocated in etcd before it kept them locally
+func (node *NodeIPM) cacheSubnet() error {
+	hostPrefix := node.nodePrefix + node.hostname + "/"
+	keyValues, err := utils.GetKeyValuesWithPrefix(node.kv, hostPrefix)
 	if err != nil {
-		fmt.Println(node)
 		return err
 	}
+	for k, v := range keyValues {
+		if err := utils.PutValue(node.ipkv, k, v); err != nil {
+			return err
+		}
+	}
+	if err := utils.PutValue(node.ipkv, node.nodePrefix+node.hostname, node.subnet.String()); err != nil {
+		return err
+	}
+	return node.kv.DeletePrefix(hostPrefix)
+}
 
-	//Since the subnet len is 24, we need to add 2^(32-24) for each subnet.
-	//(168822528 + 2^8) == 10.16.8.0
-	//(168822528 + 2* 2 ^8 ) == 10.16.9.0
-	ipNextSubnet := utils.PowTwo(32 - node.config.SubnetLen)
-	ipEnd := net.ParseIP(node.config.SubnetMax)
-
-	nextSubnet := utils.IntToIP(ipStart)
-
-	nodeToSubnets, err :=utils.GetKeyValuesWithPrefix(node.cli,subnetPrefix)
-
+// migrate moves the nodes whose subnet belongs to this network from the
+// unscoped keys into the keys of the network.
+func (node *NodeIPM) migrate() error {
+	legacyPrefix := node.config.LegacyKeyPrefix() + "node/"
+	legacy, err := utils.GetKeyValuesWithPrefix(node.kv, legacyPrefix)
 	if err != nil {
 		return err
 	}
 
-	for i := 1; ; i++ {
-		cidr := fmt.Sprintf("%s%s/%d", subnetPrefix, nextSubnet.String(), node.config.SubnetLen)
+	//$nodePrefix/hostname -> subnet tells which hosts belong to us
+	hosts := make(map[string]bool)
+	for k, v := range legacy {
+		host := strings.TrimPrefix(k, legacyPrefix)
+		if strings.Contains(host, "/") {
+			continue
+		}
+		if _, subnet, err := net.ParseCIDR(v); err == nil && node.config.InSubnetRanges(subnet) {
+			hosts[host] = true
+		}
+	}
 
-		if _, ok := nodeToSubnets[cidr]; !ok {
-			break
+	moving := make(map[string]string)
+	for k, v := range legacy {
+		rest := strings.TrimPrefix(k, legacyPrefix)
+		if strings.HasPrefix(rest, "subnets/") {
+			if hosts[v] {
+				moving[k] = v
+			}
+			continue
 		}
-		if ipEnd.String() == nextSubnet.String() {
-			return fmt.Errorf("No available subnet for registering")
+		if hosts[strings.SplitN(rest, "/", 2)[0]] {
+			moving[k] = v
 		}
-		nextSubnet = utils.IntToIP(ipStart + ipNextSubnet*uint32(i))
 	}
+	return utils.MoveKeys(node.kv, moving, legacyPrefix, node.nodePrefix)
+}
 
-	subnet := &net.IPNet{IP: nextSubnet, Mask: net.CIDRMask(node.config.SubnetLen, 32)}
-	node.subnet = subnet
+func (node *NodeIPM) checkNodeIsRegisted(kv store.KV) error {
 
-	//store the $nodePrefix/hostname -> subnet
-	err = utils.PutValue(node.cli,nodePrefix+node.hostname, subnet.String())
+	subnet, ok, err := utils.GetValue(kv, node.nodePrefix+node.hostname)
 	if err != nil {
 		return err
 	}
 
-	//store the $nodePrefix/subnets/$subnet -> hostname  for fast lookup for existing subnet
-	err = utils.PutValue(node.cli,subnetPrefix+subnet.String(), node.hostname)
+	if !ok {
+		return nil
+	}
+
+	_, node.subnet, err = net.ParseCIDR(subnet)
 	return err
 }
 
+func (node *NodeIPM) registerSubnet() error {
+	for {
+		nodeToSubnets, err := utils.GetKeyValuesWithPrefix(node.kv, node.subnetPrefix)
+		if err != nil {
+			return err
+		}
+
+		var registered []*net.IPNet
+		for k := range nodeToSubnets {
+			if _, subnet, err := net.ParseCIDR(strings.TrimPrefix(k, node.subnetPrefix)); err == nil {
+				registered = append(registered, subnet)
+			}
+		}
+		subnet, err := utils.NextSubnet(node.config, registered)
+		if err != nil {
+			utils.RecordFailure(node.kv, node.config, node.hostname)
+			return err
+		}
+
+		//store the $nodePrefix/hostname -> subnet and
+		//the $nodePrefix/subnets/$subnet -> hostname for fast lookup for existing subnet
+		//together, unless another node took the subnet in the meantime
+		ok, err := utils.PutValuesIfAbsent(node.kv, map[string]string{
+			node.nodePrefix + node.hostname:     subnet.String(),
+			node.subnetPrefix + subnet.String(): node.hostname,
+		}, utils.LeaseOpts(node.config, node.lease)...)
+		if err != nil {
+			return err
+		}
+		if ok {
+			node.subnet = subnet
+			return nil
+		}
+
+		//A concurrent ADD on this host may have registered it already,
+		//otherwise another node registered a subnet, so look again
+		if err := node.checkNodeIsRegisted(node.kv); err != nil {
+			return err
+		}
+		if node.subnet != nil {
+			return nil
+		}
+	}
+}
+
 func (node *NodeIPM) registerNode() error {
 	//Check Node Exist
-	err := node.checkNodeIsRegisted()
+	err := node.checkNodeIsRegisted(node.kv)
 	if err != nil {
 		return err
 	}
@@ -139,82 +238,97 @@ func (node *NodeIPM) GetGateway() (string, error) {
 		return "", fmt.Errorf("You should init IPM first")
 	}
 
-	gwPrefix := nodePrefix + node.hostname + "/gateway"
-	nodeValues, err := utils.GetKeyValuesWithPrefix(node.cli,gwPrefix)
+	gwPrefix := node.nodePrefix + node.hostname + "/gateway"
+	nodeValues, err := utils.GetKeyValuesWithPrefix(node.ipkv, gwPrefix)
 	if err != nil {
 		return "", err
 	}
 
 	var gwIP string
 	if len(nodeValues) == 0 {
+		//The configured gateway only applies to the node owning it
 		gwIP = utils.GetNextIP(node.subnet).String()
-		utils.PutValue(node.cli,gwPrefix, gwIP)
+		if gw := net.ParseIP(node.config.Gateway); gw != nil && node.subnet.Contains(gw) {
+			gwIP = gw.String()
+		}
+		utils.PutValue(node.ipkv, gwPrefix, gwIP, utils.LeaseOpts(node.config, node.lease)...)
 	} else {
 		gwIP = nodeValues[gwPrefix]
 	}
 	return gwIP, nil
 }
 
+// GetRoutes returns the configured routes, and the route to the other
+// nodes through the gateway of this node if clusterRoute is set
+func (node *NodeIPM) GetRoutes() ([]*types.Route, error) {
+	routes := append([]*types.Route{}, node.config.Routes...)
+	if !node.config.ClusterRoute {
+		return routes, nil
+	}
+
+	_, network, err := net.ParseCIDR(node.config.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	gwIP, err := node.GetGateway()
+	if err != nil {
+		return nil, err
+	}
+	return append(routes, &types.Route{Dst: *network, GW: net.ParseIP(gwIP)}), nil
+}
+
 func (node *NodeIPM) GetAvailableIP() (string, *net.IPNet, error) {
 	ipnet := &net.IPNet{}
 	if node.subnet == nil {
 		return "", ipnet, fmt.Errorf("You should init IPM first")
 	}
 
-	usedIPPrefix := nodePrefix + node.hostname + "/used/"
-	ipRange := utils.PowTwo(32 - (node.config.SubnetLen))
+	gwIP, err := node.GetGateway()
+	if err != nil {
+		return "", ipnet, err
+	}
 
-	//change to random a ip (must not be gateway) and try to check the etcd:
-	start := utils.GetNextIP(node.subnet)
+	allocator := utils.NewAllocator(node.ipkv, node.subnet, node.nodePrefix+node.hostname+"/", net.ParseIP(gwIP)).
+		WithOptions(utils.LeaseOpts(node.config, node.lease)...).
+		WithRange(net.ParseIP(node.config.RangeStart), net.ParseIP(node.config.RangeEnd)).
+		WithExclude(node.exclude...)
+	ipnet, err = allocator.Allocate(node.owner())
+	if err != nil {
+		utils.RecordFailure(node.ipkv, node.config, node.hostname)
+		return "", ipnet, fmt.Errorf("Failed to allocate an IP in %s: %v", node.subnet, err)
+	}
+	return ipnet.IP.String(), ipnet, nil
+}
 
-	//If ip Range = 256, our target it 2~255
-	//rand.Intn( range - 2 ) will return 0<=n<254,
-	//+2 will cause 2<=n<256
-	retryTimes := 20
-	var availableIP string
-	for i := 0; i < retryTimes; i++ {
-		tryIP := utils.GetIPByInt(start, uint32(rand.Intn(int(ipRange-2))+1))
+// Check verifies that ip is still allocated to this container, from the
+// subnet registered for this node
+func (node *NodeIPM) Check(ip net.IP) error {
+	if node.subnet == nil || !node.subnet.Contains(ip) {
+		return fmt.Errorf("%s is not in the subnet %s of %s", ip, node.subnet, node.hostname)
+	}
 
-		ipUsedToPod, err := utils.GetKeyValuesWithPrefix(node.cli,usedIPPrefix)
+	//The local store only knows the subnet it cached
+	if !node.config.LocalIPs {
+		host, ok, err := utils.GetValue(node.kv, node.subnetPrefix+node.subnet.String())
 		if err != nil {
-			return "", ipnet, err
+			return err
 		}
-
-		//check.
-		if _, ok := ipUsedToPod[usedIPPrefix+tryIP.String()]; !ok {
-			availableIP = tryIP.String()
-			utils.PutValue(node.cli,usedIPPrefix+tryIP.String(), node.podname)
-			break
+		if !ok || host != node.hostname {
+			return fmt.Errorf("The subnet %s no longer belongs to %s", node.subnet, node.hostname)
 		}
 	}
 
-	var err error
-	//We need to generate a net.IPnet object which contains the IP and Mask.
-	//We use ParseCIDR to create the net.IPnet object and assign IP back to it.
-	cidr := fmt.Sprintf("%s/%d", availableIP, node.config.SubnetLen)
-	var ip net.IP
-	ip, ipnet, err = net.ParseCIDR(cidr)
-	if err != nil {
-		return "", ipnet, err
-	}
+	allocator := utils.NewAllocator(node.ipkv, node.subnet, node.nodePrefix+node.hostname+"/")
+	return allocator.Check(node.owner(), ip)
+}
 
-	ipnet.IP = ip
-	return availableIP, ipnet, nil
+func (node *NodeIPM) owner() utils.Allocation {
+	return node.config.Owner(node.podname, node.ifname, node.hostname)
 }
 
 func (node *NodeIPM) Delete() error {
-	//get all used ip address and try to matches it id.
-	usedIPPrefix := nodePrefix + node.hostname + "/used/"
-	ipUsedToPod, err := utils.GetKeyValuesWithPrefix(node.cli,usedIPPrefix)
-	if err != nil {
-		return err
-	}
-
-	for k, v := range ipUsedToPod {
-		if v == node.podname {
-			err := utils.DeleteKey(node.cli, k)
-			return err
-		}
-	}
-	return fmt.Errorf("There aren't any infomation about %s", node.hostname)
+	allocator := utils.NewAllocator(node.ipkv, node.subnet, node.nodePrefix+node.hostname+"/").
+		WithHold(node.config.StickyHoldTime)
+	return allocator.Release(node.owner())
 }
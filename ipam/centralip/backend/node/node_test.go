@@ -15,9 +15,16 @@
 package node
 
 import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/etcdtest"
 	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -30,25 +37,20 @@ var validData = utils.IPMConfig{
 	SubnetLen: 24,
 	SubnetMin: "10.123.5.0",
 	SubnetMax: "10.123.6.0",
-	ETCDURL:   "127.0.0.1:2379",
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(etcdtest.Main(m, &validData.ETCDURL))
 }
 
 func TestNewNode(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
-	}
-	node, err = New("pod1", "host1", &validData)
+	node, err = New("pod1", "eth0", "host1", &validData)
 	assert.NoError(t, err)
 	assert.NotNil(t, node)
-	assert.Equal(t, node.config.ETCDURL, "127.0.0.1:2379")
+	assert.Equal(t, node.config.ETCDURL, validData.ETCDURL)
 }
 
 func TestGetGateway(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
-	}
 	gwIP, err := node.GetGateway()
 	assert.NoError(t, err)
 	assert.Equal(t, "10.123.5.1", gwIP)
@@ -58,10 +60,6 @@ func TestGetGateway(t *testing.T) {
 }
 
 func TestGetAvailableIP(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
-	}
 	t.Run("First IP", func(t *testing.T) {
 		ip, ipNet, err := node.GetAvailableIP()
 		assert.NoError(t, err)
@@ -90,11 +88,7 @@ func TestGetAvailableIP(t *testing.T) {
 }
 
 func TestSecondHost(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
-	}
-	node2, err := New("pod1", "host2", &validData)
+	node2, err := New("pod1", "eth0", "host2", &validData)
 	assert.NoError(t, err)
 
 	gwIP, err := node2.GetGateway()
@@ -107,11 +101,190 @@ func TestSecondHost(t *testing.T) {
 
 }
 
-func TestGenerateCentralIPMInvalid(t *testing.T) {
-	if _, defined := os.LookupEnv("TEST_ETCD"); !defined {
-		t.SkipNow()
-		return
+func TestGetRoutes(t *testing.T) {
+	routeData := validData
+	routeData.ClusterRoute = true
+	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	routeData.Routes = []*types.Route{{Dst: *defaultNet}}
+
+	n, err := New("pod1", "eth0", "host1", &routeData)
+	assert.NoError(t, err)
+
+	routes, err := n.GetRoutes()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, "0.0.0.0/0", routes[0].Dst.String())
+	assert.Equal(t, "10.123.0.0/16", routes[1].Dst.String())
+	assert.Equal(t, "10.123.5.1", routes[1].GW.String())
+}
+
+func TestCheck(t *testing.T) {
+	n, err := New("check-pod", "eth0", "host1", &validData)
+	assert.NoError(t, err)
+	ip, _, err := n.GetAvailableIP()
+	assert.NoError(t, err)
+
+	assert.NoError(t, n.Check(net.ParseIP(ip)))
+	assert.Error(t, n.Check(net.ParseIP("10.123.6.10")))
+
+	n2, err := New("check-pod", "eth0", "host2", &validData)
+	assert.NoError(t, err)
+	assert.Error(t, n2.Check(net.ParseIP(ip)))
+	assert.NoError(t, n.Delete())
+	assert.Error(t, n.Check(net.ParseIP(ip)))
+	//A retried DEL finds nothing to free
+	assert.NoError(t, n.Delete())
+}
+
+func TestLocalIPs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centralip")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	localData := validData
+	localData.Name = "local-test"
+	localData.IPType = "node"
+	localData.LocalIPs = true
+	localData.LocalStorePath = filepath.Join(dir, "local.json")
+	localData.Network = "10.133.0.0/16"
+	localData.SubnetMin = "10.133.5.0"
+	localData.SubnetMax = "10.133.6.0"
+	assert.NoError(t, utils.ValidateLocal(&localData))
+
+	n, err := New("pod1", "eth0", "host1", &localData)
+	assert.NoError(t, err)
+	ip, _, err := n.GetAvailableIP()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.133.5.2", ip)
+
+	//etcd only knows the subnet
+	subnet, ok, err := utils.GetValue(n.kv, n.nodePrefix+"host1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "10.133.5.0/24", subnet)
+	used, err := utils.UsedIPs(n.kv, &localData)
+	assert.NoError(t, err)
+	assert.Empty(t, used)
+
+	t.Run("etcd outage", func(t *testing.T) {
+		outage := localData
+		outage.ETCDURL = "127.0.0.1:23792"
+		n2, err := New("pod2", "eth0", "host1", &outage)
+		assert.NoError(t, err)
+		ip2, _, err := n2.GetAvailableIP()
+		assert.NoError(t, err)
+		assert.Equal(t, "10.133.5.3", ip2)
+		assert.NoError(t, n2.Check(net.ParseIP(ip2)))
+		assert.NoError(t, n2.Delete())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cluster := localData
+		cluster.IPType = "cluster"
+		assert.Error(t, utils.ValidateLocal(&cluster))
+		reclaim := localData
+		reclaim.LeaseTTL = 60
+		assert.Error(t, utils.ValidateLocal(&reclaim))
+		reclaim.LeaseMode = utils.LeaseModeReport
+		assert.NoError(t, utils.ValidateLocal(&reclaim))
+	})
+	assert.NoError(t, n.Delete())
+}
+
+func TestIPv6Host(t *testing.T) {
+	var v6Data = utils.IPMConfig{
+		Network:   "fd00:123::/48",
+		SubnetLen: 64,
+		SubnetMin: "fd00:123:0:5::",
+		SubnetMax: "fd00:123:0:6::",
+		ETCDURL:   validData.ETCDURL,
+	}
+
+	node6, err := New("pod1", "eth0", "host1", &v6Data)
+	assert.NoError(t, err)
+
+	gwIP, err := node6.GetGateway()
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00:123:0:5::1", gwIP)
+	ip, ipNet, err := node6.GetAvailableIP()
+	assert.NoError(t, err)
+	assert.NotEqual(t, "fd00:123:0:5::1", ip)
+	_, subnet, _ := net.ParseCIDR("fd00:123:0:5::/64")
+	assert.True(t, subnet.Contains(ipNet.IP))
+	assert.NoError(t, node6.Delete())
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	var concurrentData = utils.IPMConfig{
+		Network:   "10.125.0.0/16",
+		SubnetLen: 24,
+		SubnetMin: "10.125.1.0",
+		SubnetMax: "10.125.8.0",
+		ETCDURL:   validData.ETCDURL,
+		Name:      "concurrent",
+	}
+
+	var wg sync.WaitGroup
+	subnets := make([]string, 8)
+	errs := make([]error, len(subnets))
+	for i := range subnets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n, err := New("pod1", "eth0", fmt.Sprintf("concurrent-host%d", i), &concurrentData)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			subnets[i] = n.subnet.String()
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i, subnet := range subnets {
+		assert.NoError(t, errs[i])
+		assert.False(t, seen[subnet], "%s was registered twice", subnet)
+		seen[subnet] = true
 	}
+}
+
+func TestMigrateUnscopedKeys(t *testing.T) {
+	var scopedData = utils.IPMConfig{
+		Network:   "10.127.0.0/16",
+		SubnetLen: 24,
+		SubnetMin: "10.127.1.0",
+		SubnetMax: "10.127.9.0",
+		ETCDURL:   validData.ETCDURL,
+		Name:      "migrate-node",
+	}
+	kv, err := utils.Connect(&scopedData)
+	assert.NoError(t, err)
+	defer kv.Close()
+	err = kv.DeletePrefix(utils.ETCDPrefix + "migrate-node/")
+	assert.NoError(t, err)
+
+	legacyPrefix := utils.ETCDPrefix + "node/"
+	assert.NoError(t, utils.PutValue(kv, legacyPrefix+"migrate-host", "10.127.3.0/24"))
+	assert.NoError(t, utils.PutValue(kv, legacyPrefix+"migrate-host/used/10.127.3.7", "pod7"))
+	assert.NoError(t, utils.PutValue(kv, legacyPrefix+"subnets/10.127.3.0/24", "migrate-host"))
+
+	n, err := New("pod1", "eth0", "migrate-host", &scopedData)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.127.3.0/24", n.subnet.String())
+
+	scopedPrefix := utils.ETCDPrefix + "migrate-node/node/"
+	keyValues, err := utils.GetKeyValuesWithPrefix(kv, scopedPrefix)
+	assert.NoError(t, err)
+	assert.Equal(t, "pod7", keyValues[scopedPrefix+"migrate-host/used/10.127.3.7"])
+	assert.Equal(t, "migrate-host", keyValues[scopedPrefix+"subnets/10.127.3.0/24"])
+
+	keyValues, err = utils.GetKeyValuesWithPrefix(kv, legacyPrefix+"migrate-host")
+	assert.NoError(t, err)
+	assert.Empty(t, keyValues)
+}
+
+func TestGenerateCentralIPMInvalid(t *testing.T) {
 	var InvalidData = utils.IPMConfig{
 		Network:   "10.123.0.0/16",
 		SubnetLen: 24,
@@ -122,13 +295,13 @@ func TestGenerateCentralIPMInvalid(t *testing.T) {
 
 	t.Run("invalid etcd", func(t *testing.T) {
 		var err error
-		node, err = New("pod1", "host1", &InvalidData)
+		node, err = New("pod1", "eth0", "host1", &InvalidData)
 		assert.Error(t, err)
 		assert.Nil(t, node)
 	})
 	t.Run("no available subnet", func(t *testing.T) {
 		var err error
-		node, err = New("pod1", "host3", &validData)
+		node, err = New("pod1", "eth0", "host3", &validData)
 		assert.Error(t, err)
 		assert.Nil(t, node)
 	})
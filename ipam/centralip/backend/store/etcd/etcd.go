@@ -0,0 +1,279 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"sort"
+	"time"
+)
+
+const firstBackoff = 100 * time.Millisecond
+
+// Options tunes the requests of a Store
+type Options struct {
+	// RequestTimeout bounds each attempt of a request
+	RequestTimeout time.Duration
+	// Retries is how many times a request failing with a transient error,
+	// such as a leader election or an unreachable member, is retried. The
+	// wait between attempts doubles from 100ms.
+	Retries int
+}
+
+// Store keeps the state of centralip in etcd-v3
+type Store struct {
+	cli  *clientv3.Client
+	opts Options
+}
+
+func New(cli *clientv3.Client, opts Options) *Store {
+	return &Store{cli: cli, opts: opts}
+}
+
+func isTransient(err error) bool {
+	switch err {
+	case context.DeadlineExceeded, rpctypes.ErrNoLeader, rpctypes.ErrNotLeader, rpctypes.ErrStopped,
+		rpctypes.ErrTimeout, rpctypes.ErrTimeoutDueToLeaderFail, rpctypes.ErrTimeoutDueToConnectionLost,
+		rpctypes.ErrTooManyRequests, rpctypes.ErrUnhealthy:
+		return true
+	}
+	code := grpc.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// do runs fn with a timeout, retrying it on transient errors. A retried
+// transaction may have been applied by the attempt that timed out, in
+// which case its comparisons fail and the caller sees a conflict.
+func (s *Store) do(fn func(ctx context.Context) error) error {
+	backoff := firstBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), s.opts.RequestTimeout)
+		err := fn(ctx)
+		cancel()
+		if err == nil || attempt >= s.opts.Retries || !isTransient(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func toKeyValue(kv *mvccpb.KeyValue) *store.KeyValue {
+	return &store.KeyValue{
+		Key:         string(kv.Key),
+		Value:       string(kv.Value),
+		ModRevision: kv.ModRevision,
+		Lease:       store.LeaseID(kv.Lease),
+	}
+}
+
+func (s *Store) Get(key string) (*store.KeyValue, error) {
+	var resp *clientv3.GetResponse
+	err := s.do(func(ctx context.Context) (err error) {
+		resp, err = s.cli.Get(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Fetch etcd key error:%v", err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return toKeyValue(resp.Kvs[0]), nil
+}
+
+func (s *Store) List(prefix string) (map[string]string, error) {
+	var resp *clientv3.GetResponse
+	err := s.do(func(ctx context.Context) (err error) {
+		resp, err = s.cli.Get(ctx, prefix, clientv3.WithPrefix())
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Fetch etcd prefix error:%v", err)
+	}
+
+	results := make(map[string]string)
+	for _, ev := range resp.Kvs {
+		results[string(ev.Key)] = string(ev.Value)
+	}
+	return results, nil
+}
+
+func (s *Store) Range(prefix string) ([]store.KeyValue, int64, error) {
+	var resp *clientv3.GetResponse
+	err := s.do(func(ctx context.Context) (err error) {
+		resp, err = s.cli.Get(ctx, prefix, clientv3.WithPrefix())
+		return err
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("Fetch etcd prefix error:%v", err)
+	}
+
+	var kvs []store.KeyValue
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, *toKeyValue(kv))
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, resp.Header.Revision, nil
+}
+
+func (s *Store) Put(key, value string, opts ...store.OpOption) error {
+	_, err := s.Txn(nil, []store.Op{store.OpPut(key, value, opts...)}, nil)
+	return err
+}
+
+func (s *Store) Delete(key string) error {
+	return s.do(func(ctx context.Context) error {
+		_, err := s.cli.Delete(ctx, key)
+		return err
+	})
+}
+
+func (s *Store) DeletePrefix(prefix string) error {
+	return s.do(func(ctx context.Context) error {
+		_, err := s.cli.Delete(ctx, prefix, clientv3.WithPrefix())
+		return err
+	})
+}
+
+func toCmp(cmp store.Cmp) clientv3.Cmp {
+	switch cmp.Target {
+	case store.CmpValue:
+		return clientv3.Compare(clientv3.Value(cmp.Key), "=", cmp.Value)
+	case store.CmpModRevision:
+		return clientv3.Compare(clientv3.ModRevision(cmp.Key), "=", cmp.Revision)
+	case store.CmpPrefixUnchanged:
+		return clientv3.Compare(clientv3.ModRevision(cmp.Key), "<", cmp.Revision+1).WithPrefix()
+	default:
+		return clientv3.Compare(clientv3.CreateRevision(cmp.Key), "=", 0)
+	}
+}
+
+func toOps(ops []store.Op) []clientv3.Op {
+	var etcdOps []clientv3.Op
+	for _, op := range ops {
+		if op.Delete && op.Prefix {
+			etcdOps = append(etcdOps, clientv3.OpDelete(op.Key, clientv3.WithPrefix()))
+		} else if op.Delete {
+			etcdOps = append(etcdOps, clientv3.OpDelete(op.Key))
+		} else if op.Lease != store.NoLease {
+			etcdOps = append(etcdOps, clientv3.OpPut(op.Key, op.Value, clientv3.WithLease(clientv3.LeaseID(op.Lease))))
+		} else {
+			etcdOps = append(etcdOps, clientv3.OpPut(op.Key, op.Value))
+		}
+	}
+	return etcdOps
+}
+
+func (s *Store) Txn(cmps []store.Cmp, then, els []store.Op) (bool, error) {
+	var etcdCmps []clientv3.Cmp
+	for _, cmp := range cmps {
+		etcdCmps = append(etcdCmps, toCmp(cmp))
+	}
+
+	var resp *clientv3.TxnResponse
+	err := s.do(func(ctx context.Context) (err error) {
+		resp, err = s.cli.Txn(ctx).If(etcdCmps...).Then(toOps(then)...).Else(toOps(els)...).Commit()
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("Etcd transaction error:%v", err)
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *Store) Watch(ctx context.Context, prefix string, opts ...store.WatchOption) <-chan store.Event {
+	options := store.NewWatchOptions(opts...)
+	events := make(chan store.Event)
+	go func() {
+		defer close(events)
+		watchOpts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV()}
+		if options.Revision > 0 {
+			watchOpts = append(watchOpts, clientv3.WithRev(options.Revision))
+		}
+		for resp := range s.cli.Watch(ctx, prefix, watchOpts...) {
+			if resp.CompactRevision > 0 {
+				event := store.Event{Type: store.EventCompacted, KeyValue: store.KeyValue{ModRevision: resp.CompactRevision}}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+				}
+				return
+			}
+			for _, ev := range resp.Events {
+				event := store.Event{Type: store.EventPut, KeyValue: *toKeyValue(ev.Kv)}
+				if ev.Type == mvccpb.DELETE {
+					event.Type = store.EventDelete
+					if ev.PrevKv != nil {
+						event.Value = string(ev.PrevKv.Value)
+						event.Lease = store.LeaseID(ev.PrevKv.Lease)
+					}
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
+
+func (s *Store) Grant(ttl int64) (store.LeaseID, error) {
+	var resp *clientv3.LeaseGrantResponse
+	err := s.do(func(ctx context.Context) (err error) {
+		resp, err = s.cli.Grant(ctx, ttl)
+		return err
+	})
+	if err != nil {
+		return store.NoLease, err
+	}
+	return store.LeaseID(resp.ID), nil
+}
+
+func (s *Store) KeepAlive(id store.LeaseID) error {
+	err := s.do(func(ctx context.Context) error {
+		_, err := s.cli.KeepAliveOnce(ctx, clientv3.LeaseID(id))
+		return err
+	})
+	if err == rpctypes.ErrLeaseNotFound {
+		return store.ErrLeaseNotFound
+	}
+	return err
+}
+
+func (s *Store) Revoke(id store.LeaseID) error {
+	err := s.do(func(ctx context.Context) error {
+		_, err := s.cli.Revoke(ctx, clientv3.LeaseID(id))
+		return err
+	})
+	if err == rpctypes.ErrLeaseNotFound {
+		return store.ErrLeaseNotFound
+	}
+	return err
+}
+
+func (s *Store) Close() error {
+	return s.cli.Close()
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	s := &Store{opts: Options{RequestTimeout: time.Second, Retries: 2}}
+
+	calls := 0
+	err := s.do(func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return rpctypes.ErrNoLeader
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = s.do(func(ctx context.Context) error {
+		calls++
+		return context.DeadlineExceeded
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = s.do(func(ctx context.Context) error {
+		calls++
+		return fmt.Errorf("permission denied")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,424 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultPath = "/var/lib/cni/centralip/store.json"
+
+// pollInterval is how often Watch looks for changes of the file
+var pollInterval = time.Second
+
+// historyLimit is how many changes the file keeps for Watch to resume from
+var historyLimit = 1000
+
+type entry struct {
+	Value       string        `json:"value"`
+	ModRevision int64         `json:"modRevision"`
+	Lease       store.LeaseID `json:"lease,omitempty"`
+}
+
+type lease struct {
+	TTL    int64     `json:"ttl"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// change is a put or delete of a key at a revision. Value is the value
+// before a delete.
+type change struct {
+	Revision int64         `json:"revision"`
+	Key      string        `json:"key"`
+	Value    string        `json:"value"`
+	Lease    store.LeaseID `json:"lease,omitempty"`
+	Delete   bool          `json:"delete,omitempty"`
+}
+
+type state struct {
+	Revision  int64                   `json:"revision"`
+	LastLease store.LeaseID           `json:"lastLease"`
+	Keys      map[string]*entry       `json:"keys"`
+	Leases    map[store.LeaseID]lease `json:"leases"`
+	// History holds the last changes, and Compacted the last revision
+	// dropped from it
+	History   []change `json:"history,omitempty"`
+	Compacted int64    `json:"compacted"`
+}
+
+// Store is a simple disk-backed store keeping all the keys in one JSON
+// file, for single node setups without etcd. Every access locks the file,
+// so the plugins running on the node see a consistent state.
+type Store struct {
+	path string
+}
+
+// New returns a store keeping its keys in path, /var/lib/cni/centralip/store.json
+// by default
+func New(path string) (*Store, error) {
+	if path == "" {
+		path = defaultPath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &Store{path: path}, nil
+}
+
+// update runs fn on the state with the file locked, and saves the state if
+// fn returns true
+func (s *Store) update(fn func(st *state) (bool, error)) error {
+	lock, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	st := &state{Keys: make(map[string]*entry), Leases: make(map[store.LeaseID]lease)}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, st); err != nil {
+			return err
+		}
+	}
+
+	expired := st.expire(time.Now())
+	changed, err := fn(st)
+	if err != nil || !(changed || expired) {
+		return err
+	}
+
+	data, err = json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// expire drops the expired leases with their keys
+func (st *state) expire(now time.Time) bool {
+	expired := false
+	for id, l := range st.Leases {
+		if now.After(l.Expiry) {
+			st.revoke(id)
+			expired = true
+		}
+	}
+	return expired
+}
+
+func (st *state) revoke(id store.LeaseID) {
+	delete(st.Leases, id)
+	var ops []store.Op
+	for k, e := range st.Keys {
+		if e.Lease == id {
+			ops = append(ops, store.OpDelete(k))
+		}
+	}
+	st.apply(ops)
+}
+
+func (st *state) holds(cmp store.Cmp) bool {
+	e, ok := st.Keys[cmp.Key]
+	switch cmp.Target {
+	case store.CmpValue:
+		return ok && e.Value == cmp.Value
+	case store.CmpModRevision:
+		return ok && e.ModRevision == cmp.Revision
+	case store.CmpPrefixUnchanged:
+		for k, e := range st.Keys {
+			if strings.HasPrefix(k, cmp.Key) && e.ModRevision > cmp.Revision {
+				return false
+			}
+		}
+		return true
+	default:
+		return !ok
+	}
+}
+
+func (st *state) apply(ops []store.Op) {
+	if len(ops) == 0 {
+		return
+	}
+	st.Revision++
+	//Files written before the history know nothing of the older revisions
+	if len(st.History) == 0 {
+		st.Compacted = st.Revision - 1
+	}
+	for _, op := range ops {
+		if op.Delete {
+			keys := []string{op.Key}
+			if op.Prefix {
+				keys = nil
+				for k := range st.Keys {
+					if strings.HasPrefix(k, op.Key) {
+						keys = append(keys, k)
+					}
+				}
+				sort.Strings(keys)
+			}
+			for _, k := range keys {
+				if e, ok := st.Keys[k]; ok {
+					st.History = append(st.History, change{Revision: st.Revision, Key: k, Value: e.Value, Lease: e.Lease, Delete: true})
+					delete(st.Keys, k)
+				}
+			}
+			continue
+		}
+		st.Keys[op.Key] = &entry{Value: op.Value, ModRevision: st.Revision, Lease: op.Lease}
+		st.History = append(st.History, change{Revision: st.Revision, Key: op.Key, Value: op.Value, Lease: op.Lease})
+	}
+	if drop := len(st.History) - historyLimit; drop > 0 {
+		st.Compacted = st.History[drop-1].Revision
+		st.History = append([]change{}, st.History[drop:]...)
+	}
+}
+
+// changes returns the changes under the prefix from revision on, and the
+// revision to read the next changes from. It fails with compacted set if
+// the history no longer goes back to revision.
+func (s *Store) changes(prefix string, revision int64) ([]store.Event, int64, bool, error) {
+	var events []store.Event
+	var next int64
+	compacted := false
+	err := s.update(func(st *state) (bool, error) {
+		next = st.Revision + 1
+		if revision <= st.Compacted || (len(st.History) == 0 && revision <= st.Revision) {
+			compacted = true
+			if len(st.History) > 0 {
+				next = st.Compacted + 1
+			}
+			return false, nil
+		}
+		for _, c := range st.History {
+			if c.Revision < revision || !strings.HasPrefix(c.Key, prefix) {
+				continue
+			}
+			event := store.Event{Type: store.EventPut, KeyValue: store.KeyValue{Key: c.Key, Value: c.Value, ModRevision: c.Revision, Lease: c.Lease}}
+			if c.Delete {
+				event.Type = store.EventDelete
+			}
+			events = append(events, event)
+		}
+		return false, nil
+	})
+	return events, next, compacted, err
+}
+
+func (s *Store) Get(key string) (*store.KeyValue, error) {
+	var kv *store.KeyValue
+	err := s.update(func(st *state) (bool, error) {
+		if e, ok := st.Keys[key]; ok {
+			kv = &store.KeyValue{Key: key, Value: e.Value, ModRevision: e.ModRevision, Lease: e.Lease}
+		}
+		return false, nil
+	})
+	return kv, err
+}
+
+// list returns the keys under the prefix and the revision of the state
+func (s *Store) list(prefix string) (map[string]store.KeyValue, int64, error) {
+	results := make(map[string]store.KeyValue)
+	var revision int64
+	err := s.update(func(st *state) (bool, error) {
+		for k, e := range st.Keys {
+			if strings.HasPrefix(k, prefix) {
+				results[k] = store.KeyValue{Key: k, Value: e.Value, ModRevision: e.ModRevision, Lease: e.Lease}
+			}
+		}
+		revision = st.Revision
+		return false, nil
+	})
+	return results, revision, err
+}
+
+func (s *Store) List(prefix string) (map[string]string, error) {
+	kvs, _, err := s.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]string)
+	for k, kv := range kvs {
+		results[k] = kv.Value
+	}
+	return results, nil
+}
+
+func (s *Store) Range(prefix string) ([]store.KeyValue, int64, error) {
+	results, revision, err := s.list(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var kvs []store.KeyValue
+	for _, kv := range results {
+		kvs = append(kvs, kv)
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, revision, nil
+}
+
+func (s *Store) Put(key, value string, opts ...store.OpOption) error {
+	_, err := s.Txn(nil, []store.Op{store.OpPut(key, value, opts...)}, nil)
+	return err
+}
+
+func (s *Store) Delete(key string) error {
+	_, err := s.Txn(nil, []store.Op{store.OpDelete(key)}, nil)
+	return err
+}
+
+func (s *Store) DeletePrefix(prefix string) error {
+	return s.update(func(st *state) (bool, error) {
+		var ops []store.Op
+		for k := range st.Keys {
+			if strings.HasPrefix(k, prefix) {
+				ops = append(ops, store.OpDelete(k))
+			}
+		}
+		st.apply(ops)
+		return len(ops) > 0, nil
+	})
+}
+
+func (s *Store) Txn(cmps []store.Cmp, then, els []store.Op) (bool, error) {
+	succeeded := true
+	err := s.update(func(st *state) (bool, error) {
+		for _, cmp := range cmps {
+			if !st.holds(cmp) {
+				succeeded = false
+				break
+			}
+		}
+
+		ops := then
+		if !succeeded {
+			ops = els
+		}
+		for _, op := range ops {
+			if _, ok := st.Leases[op.Lease]; op.Lease != store.NoLease && !ok {
+				return false, store.ErrLeaseNotFound
+			}
+		}
+		st.apply(ops)
+		return len(ops) > 0, nil
+	})
+	return succeeded, err
+}
+
+// Watch polls the history of the file, since other processes write it.
+// A watch starting at a revision older than the history is compacted.
+func (s *Store) Watch(ctx context.Context, prefix string, opts ...store.WatchOption) <-chan store.Event {
+	options := store.NewWatchOptions(opts...)
+	events := make(chan store.Event)
+	go func() {
+		defer close(events)
+		revision := options.Revision
+		if revision == 0 {
+			_, current, err := s.list(prefix)
+			if err != nil {
+				return
+			}
+			revision = current + 1
+		}
+		for {
+			changes, next, compacted, err := s.changes(prefix, revision)
+			if err == nil && compacted {
+				event := store.Event{Type: store.EventCompacted, KeyValue: store.KeyValue{ModRevision: next}}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if err == nil {
+				revision = next
+			}
+			for _, event := range changes {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollInterval):
+			}
+		}
+	}()
+	return events
+}
+
+func (s *Store) Grant(ttl int64) (store.LeaseID, error) {
+	var id store.LeaseID
+	err := s.update(func(st *state) (bool, error) {
+		st.LastLease++
+		id = st.LastLease
+		st.Leases[id] = lease{TTL: ttl, Expiry: time.Now().Add(time.Duration(ttl) * time.Second)}
+		return true, nil
+	})
+	return id, err
+}
+
+func (s *Store) KeepAlive(id store.LeaseID) error {
+	return s.update(func(st *state) (bool, error) {
+		l, ok := st.Leases[id]
+		if !ok {
+			return false, store.ErrLeaseNotFound
+		}
+		l.Expiry = time.Now().Add(time.Duration(l.TTL) * time.Second)
+		st.Leases[id] = l
+		return true, nil
+	})
+}
+
+func (s *Store) Revoke(id store.LeaseID) error {
+	return s.update(func(st *state) (bool, error) {
+		if _, ok := st.Leases[id]; !ok {
+			return false, store.ErrLeaseNotFound
+		}
+		st.revoke(id)
+		return true, nil
+	})
+}
+
+func (s *Store) Close() error {
+	return nil
+}
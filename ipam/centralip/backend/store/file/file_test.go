@@ -0,0 +1,202 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"context"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "centralip")
+	assert.NoError(t, err)
+	s, err := New(filepath.Join(dir, "store.json"))
+	assert.NoError(t, err)
+	return s
+}
+
+func TestTxn(t *testing.T) {
+	s := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(s.path))
+
+	ok, err := s.Txn([]store.Cmp{store.Absent("a")}, []store.Op{store.OpPut("a", "1")}, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = s.Txn([]store.Cmp{store.Absent("a")}, []store.Op{store.OpPut("a", "2")}, nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	kv, err := s.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", kv.Value)
+
+	ok, err = s.Txn([]store.Cmp{store.ModRevisionEquals("a", kv.ModRevision)}, []store.Op{store.OpDelete("a")}, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	kv, err = s.Get("a")
+	assert.NoError(t, err)
+	assert.Nil(t, kv)
+}
+
+func TestPrefix(t *testing.T) {
+	s := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(s.path))
+
+	assert.NoError(t, s.Put("dir/a", "1"))
+	assert.NoError(t, s.Put("dir/b", "2"))
+	assert.NoError(t, s.Put("other", "3"))
+
+	values, err := s.List("dir/")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"dir/a": "1", "dir/b": "2"}, values)
+
+	//Nothing under dir/ was written since b
+	b, err := s.Get("dir/b")
+	assert.NoError(t, err)
+	ok, err := s.Txn([]store.Cmp{store.PrefixUnchangedSince("dir/", b.ModRevision-1)}, []store.Op{store.OpDeletePrefix("dir/")}, nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = s.Txn([]store.Cmp{store.PrefixUnchangedSince("dir/", b.ModRevision)}, []store.Op{store.OpDeletePrefix("dir/")}, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	values, err = s.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"other": "3"}, values)
+
+	assert.NoError(t, s.Put("dir/c", "4"))
+	assert.NoError(t, s.DeletePrefix("dir/"))
+	values, err = s.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"other": "3"}, values)
+}
+
+func TestLease(t *testing.T) {
+	s := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(s.path))
+
+	id, err := s.Grant(60)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put("leased", "1", store.WithLease(id)))
+	assert.NoError(t, s.KeepAlive(id))
+
+	kv, err := s.Get("leased")
+	assert.NoError(t, err)
+	assert.Equal(t, id, kv.Lease)
+
+	assert.NoError(t, s.Revoke(id))
+	kv, err = s.Get("leased")
+	assert.NoError(t, err)
+	assert.Nil(t, kv)
+	assert.Equal(t, store.ErrLeaseNotFound, s.KeepAlive(id))
+
+	id, err = s.Grant(1)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put("expired", "1", store.WithLease(id)))
+	time.Sleep(1100 * time.Millisecond)
+	kv, err = s.Get("expired")
+	assert.NoError(t, err)
+	assert.Nil(t, kv)
+}
+
+func TestWatch(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	s := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(s.path))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := s.Watch(ctx, "dir/")
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NoError(t, s.Put("dir/a", "1"))
+	event := <-events
+	assert.Equal(t, store.EventPut, event.Type)
+	assert.Equal(t, "dir/a", event.Key)
+
+	assert.NoError(t, s.Delete("dir/a"))
+	event = <-events
+	assert.Equal(t, store.EventDelete, event.Type)
+	assert.Equal(t, "dir/a", event.Key)
+}
+
+func TestWatchRevision(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	s := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(s.path))
+
+	assert.NoError(t, s.Put("dir/a", "1"))
+	assert.NoError(t, s.Put("other", "2"))
+	assert.NoError(t, s.Delete("dir/a"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := s.Watch(ctx, "dir/", store.WithRevision(1))
+	event := <-events
+	assert.Equal(t, store.EventPut, event.Type)
+	assert.Equal(t, int64(1), event.ModRevision)
+	event = <-events
+	assert.Equal(t, store.EventDelete, event.Type)
+	assert.Equal(t, "1", event.Value)
+	assert.Equal(t, int64(3), event.ModRevision)
+
+	//The history only keeps the last changes
+	defer func(limit int) { historyLimit = limit }(historyLimit)
+	historyLimit = 2
+	assert.NoError(t, s.Put("dir/b", "3"))
+	event = <-events
+	assert.Equal(t, "dir/b", event.Key)
+	event = <-s.Watch(ctx, "dir/", store.WithRevision(2))
+	assert.Equal(t, store.EventCompacted, event.Type)
+	assert.Equal(t, int64(3), event.ModRevision)
+}
+
+func TestRange(t *testing.T) {
+	pollInterval = 10 * time.Millisecond
+	s := newTestStore(t)
+	defer os.RemoveAll(filepath.Dir(s.path))
+
+	assert.NoError(t, s.Put("dir/b", "2"))
+	assert.NoError(t, s.Put("dir/a", "1"))
+	assert.NoError(t, s.Put("other", "3"))
+	kvs, revision, err := s.Range("dir/")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), revision)
+	assert.Len(t, kvs, 2)
+	assert.Equal(t, "dir/a", kvs[0].Key)
+	assert.Equal(t, int64(2), kvs[0].ModRevision)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//Watching from a revision of Range replays what followed it
+	event := <-s.Watch(ctx, "dir/", store.WithRevision(kvs[0].ModRevision))
+	assert.Equal(t, store.EventPut, event.Type)
+	assert.Equal(t, "dir/a", event.Key)
+
+	events := s.Watch(ctx, "dir/", store.WithRevision(revision+1))
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, s.Delete("dir/b"))
+	event = <-events
+	assert.Equal(t, store.EventDelete, event.Type)
+	assert.Equal(t, "2", event.Value)
+	assert.Equal(t, revision+1, event.ModRevision)
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrLeaseNotFound is returned when renewing a lease that expired
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// LeaseID identifies a lease. Keys attached to a lease are deleted when
+// it expires.
+type LeaseID int64
+
+// NoLease is the zero LeaseID, for keys that never expire
+const NoLease LeaseID = 0
+
+// KeyValue is a key with its value and the revision of its last write
+type KeyValue struct {
+	Key         string
+	Value       string
+	ModRevision int64
+	Lease       LeaseID
+}
+
+// CmpTarget is the property of a key compared in a transaction
+type CmpTarget int
+
+const (
+	// CmpAbsent holds if the key doesn't exist
+	CmpAbsent CmpTarget = iota
+	// CmpValue holds if the key exists with the value
+	CmpValue
+	// CmpModRevision holds if the key was last written at the revision
+	CmpModRevision
+	// CmpPrefixUnchanged holds if no key under the prefix was written
+	// after the revision
+	CmpPrefixUnchanged
+)
+
+// Cmp is a condition of a transaction
+type Cmp struct {
+	Key      string
+	Target   CmpTarget
+	Value    string
+	Revision int64
+}
+
+// Absent holds if the key doesn't exist
+func Absent(key string) Cmp {
+	return Cmp{Key: key, Target: CmpAbsent}
+}
+
+// ValueEquals holds if the key exists with the value
+func ValueEquals(key, value string) Cmp {
+	return Cmp{Key: key, Target: CmpValue, Value: value}
+}
+
+// ModRevisionEquals holds if the key was last written at the revision
+func ModRevisionEquals(key string, revision int64) Cmp {
+	return Cmp{Key: key, Target: CmpModRevision, Revision: revision}
+}
+
+// PrefixUnchangedSince holds if no key under the prefix was written after
+// the revision. Keys deleted since then don't count.
+func PrefixUnchangedSince(prefix string, revision int64) Cmp {
+	return Cmp{Key: prefix, Target: CmpPrefixUnchanged, Revision: revision}
+}
+
+// Op is a write of a transaction. A delete with Prefix deletes all the keys
+// under Key.
+type Op struct {
+	Key    string
+	Value  string
+	Delete bool
+	Prefix bool
+	Lease  LeaseID
+}
+
+// OpOption configures an Op
+type OpOption func(*Op)
+
+// WithLease attaches the key to the lease
+func WithLease(id LeaseID) OpOption {
+	return func(op *Op) {
+		op.Lease = id
+	}
+}
+
+// OpPut writes the value of the key
+func OpPut(key, value string, opts ...OpOption) Op {
+	op := Op{Key: key, Value: value}
+	for _, opt := range opts {
+		opt(&op)
+	}
+	return op
+}
+
+// OpDelete deletes the key
+func OpDelete(key string) Op {
+	return Op{Key: key, Delete: true}
+}
+
+// OpDeletePrefix deletes all the keys under the prefix
+func OpDeletePrefix(prefix string) Op {
+	return Op{Key: prefix, Delete: true, Prefix: true}
+}
+
+// EventType tells whether a watched key was written or deleted
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+	// EventCompacted ends a watch whose start revision is no longer known
+	// to the store. Its ModRevision is the oldest revision the store can
+	// still watch from, and the watcher has to read the keys again.
+	EventCompacted
+)
+
+// Event is a change of a watched key. The ModRevision of a delete is the
+// revision of the delete, and its Value is the last value of the key.
+type Event struct {
+	Type EventType
+	KeyValue
+}
+
+// WatchOptions configures a Watch
+type WatchOptions struct {
+	Revision int64
+}
+
+// WatchOption configures a Watch
+type WatchOption func(*WatchOptions)
+
+// WithRevision starts the watch at the revision, so the changes made
+// since then are sent first
+func WithRevision(revision int64) WatchOption {
+	return func(opts *WatchOptions) {
+		opts.Revision = revision
+	}
+}
+
+// NewWatchOptions applies opts
+func NewWatchOptions(opts ...WatchOption) WatchOptions {
+	var options WatchOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// KV is the key-value store holding the state of centralip
+type KV interface {
+	// Get returns the key, or nil if it doesn't exist
+	Get(key string) (*KeyValue, error)
+	// List returns the values of the keys under the prefix
+	List(prefix string) (map[string]string, error)
+	// Range returns the keys under the prefix sorted by key, and the
+	// revision of the store they were read at
+	Range(prefix string) ([]KeyValue, int64, error)
+	Put(key, value string, opts ...OpOption) error
+	Delete(key string) error
+	DeletePrefix(prefix string) error
+
+	// Txn runs the then ops if all the cmps hold, and the els ops
+	// otherwise, and reports whether the cmps held
+	Txn(cmps []Cmp, then, els []Op) (bool, error)
+
+	// Watch sends the changes of the keys under the prefix until ctx is
+	// done, then closes the channel
+	Watch(ctx context.Context, prefix string, opts ...WatchOption) <-chan Event
+
+	// Grant creates a lease expiring after ttl seconds without KeepAlive
+	Grant(ttl int64) (LeaseID, error)
+	// KeepAlive renews the lease, or returns ErrLeaseNotFound
+	KeepAlive(id LeaseID) error
+	// Revoke expires the lease right away
+	Revoke(id LeaseID) error
+
+	Close() error
+}
@@ -0,0 +1,494 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ErrPoolExhausted is returned when every address of the subnet is in use
+var ErrPoolExhausted = errors.New("pool exhausted")
+
+// Allocator hands out the addresses of a subnet in order, resuming after
+// the last allocated one the way host-local does. The network, broadcast
+// and reserved addresses are never handed out.
+//
+// Under its prefix, the allocator keeps
+//
+//	used/$ip -> the Allocation owning the IP
+//	containers/$containerID/$ifName -> $ip, to release it without a scan
+//	indexed -> set once no allocation predates the containers index
+//	lastReserved -> the last allocated IP
+//	pods/$namespace/$name -> the sticky IP of a Kubernetes pod
+type Allocator struct {
+	kv       store.KV
+	subnet   *net.IPNet
+	prefix   string
+	reserved map[string]bool
+	opts     []store.OpOption
+	hold     int64
+
+	rangeStart net.IP
+	rangeEnd   net.IP
+	exclude    []*net.IPNet
+}
+
+// NewAllocator returns an allocator keeping its keys under prefix
+func NewAllocator(kv store.KV, subnet *net.IPNet, prefix string, reserved ...net.IP) *Allocator {
+	a := &Allocator{
+		kv:       kv,
+		subnet:   subnet,
+		prefix:   prefix,
+		reserved: make(map[string]bool),
+	}
+	for _, ip := range reserved {
+		if ip != nil {
+			a.reserved[ip.String()] = true
+		}
+	}
+	return a
+}
+
+// WithOptions passes opts, such as a lease, to the keys written for each
+// allocation
+func (a *Allocator) WithOptions(opts ...store.OpOption) *Allocator {
+	a.opts = opts
+	return a
+}
+
+// WithHold keeps the IP of an owner with a pod identity for hold seconds
+// after its release, so the next container of the pod gets it back
+func (a *Allocator) WithHold(hold int64) *Allocator {
+	a.hold = hold
+	return a
+}
+
+// WithRange limits the allocations to start..end. Each bound only applies
+// if it belongs to the subnet, so that one range can be shared by the
+// subnets of all nodes.
+func (a *Allocator) WithRange(start, end net.IP) *Allocator {
+	a.rangeStart = start
+	a.rangeEnd = end
+	return a
+}
+
+// WithExclude keeps the addresses of the networks out of the pool
+func (a *Allocator) WithExclude(exclude ...*net.IPNet) *Allocator {
+	a.exclude = exclude
+	return a
+}
+
+func (a *Allocator) excluded(ip net.IP) bool {
+	for _, ipnet := range a.exclude {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allocator) usedPrefix() string {
+	return a.prefix + "used/"
+}
+
+func (a *Allocator) containerKey(owner Allocation) string {
+	return a.prefix + "containers/" + owner.ContainerID + "/" + owner.IfName
+}
+
+func (a *Allocator) podKey(pod string) string {
+	return a.prefix + "pods/" + pod
+}
+
+// bounds returns the first and last addresses that may be allocated
+func (a *Allocator) bounds() (*big.Int, *big.Int) {
+	ones, bits := a.subnet.Mask.Size()
+	first := IPToBigInt(a.subnet.IP.Mask(a.subnet.Mask))
+	last := new(big.Int).Add(first, HostCount(ones, bits))
+	last.Sub(last, big.NewInt(1))
+
+	//Point-to-point subnets have neither network nor broadcast address
+	if bits-ones >= 2 {
+		//Skip the network address, and the broadcast address for IPv4
+		first.Add(first, big.NewInt(1))
+		if bits == 8*net.IPv4len {
+			last.Sub(last, big.NewInt(1))
+		}
+	}
+
+	if a.rangeStart != nil && a.subnet.Contains(a.rangeStart) {
+		if start := IPToBigInt(a.rangeStart); start.Cmp(first) > 0 {
+			first = start
+		}
+	}
+	if a.rangeEnd != nil && a.subnet.Contains(a.rangeEnd) {
+		if end := IPToBigInt(a.rangeEnd); end.Cmp(last) < 0 {
+			last = end
+		}
+	}
+	return first, last
+}
+
+// excludedRanges returns the excluded addresses within first..last, as
+// sorted ranges that don't overlap
+func (a *Allocator) excludedRanges(first, last *big.Int) [][2]*big.Int {
+	var ranges [][2]*big.Int
+	for _, ipnet := range a.exclude {
+		ones, bits := ipnet.Mask.Size()
+		lo := IPToBigInt(ipnet.IP.Mask(ipnet.Mask))
+		hi := new(big.Int).Add(lo, HostCount(ones, bits))
+		hi.Sub(hi, big.NewInt(1))
+		if lo.Cmp(first) < 0 {
+			lo = new(big.Int).Set(first)
+		}
+		if hi.Cmp(last) > 0 {
+			hi = new(big.Int).Set(last)
+		}
+		if lo.Cmp(hi) <= 0 {
+			ranges = append(ranges, [2]*big.Int{lo, hi})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0].Cmp(ranges[j][0]) < 0
+	})
+
+	var merged [][2]*big.Int
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0].Cmp(new(big.Int).Add(merged[n-1][1], big.NewInt(1))) <= 0 {
+			if r[1].Cmp(merged[n-1][1]) > 0 {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Size returns the number of addresses the allocator may hand out
+func (a *Allocator) Size() *big.Int {
+	first, last := a.bounds()
+	size := new(big.Int).Sub(last, first)
+	size.Add(size, big.NewInt(1))
+	if size.Sign() <= 0 {
+		return new(big.Int)
+	}
+
+	for _, r := range a.excludedRanges(first, last) {
+		size.Sub(size, new(big.Int).Sub(r[1], r[0]))
+		size.Sub(size, big.NewInt(1))
+	}
+
+	for reserved := range a.reserved {
+		ip := net.ParseIP(reserved)
+		n := IPToBigInt(ip)
+		if n.Cmp(first) >= 0 && n.Cmp(last) <= 0 && !a.excluded(ip) {
+			size.Sub(size, big.NewInt(1))
+		}
+	}
+	return size
+}
+
+// allocated returns the IP already allocated to owner, if any, so that a
+// retried ADD gets the same address back
+func (a *Allocator) allocated(owner Allocation) (*net.IPNet, error) {
+	value, ok, err := GetValue(a.kv, a.containerKey(owner))
+	if err != nil || !ok {
+		return nil, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil || !a.subnet.Contains(ip) {
+		return nil, fmt.Errorf("%s already holds %s outside of %s", owner, value, a.subnet)
+	}
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: a.subnet.Mask}, nil
+}
+
+// allocatable reports whether ip may be handed out at all
+func (a *Allocator) allocatable(ip net.IP) bool {
+	first, last := a.bounds()
+	n := IPToBigInt(ip)
+	return a.subnet.Contains(ip) && n.Cmp(first) >= 0 && n.Cmp(last) <= 0 &&
+		!a.reserved[ip.String()] && !a.excluded(ip)
+}
+
+// reclaim gives owner the sticky IP of its pod, if it is held for the pod
+// or free
+func (a *Allocator) reclaim(owner Allocation) (*net.IPNet, error) {
+	value, ok, err := GetValue(a.kv, a.podKey(owner.Pod))
+	if err != nil || !ok {
+		return nil, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil || !a.allocatable(ip) {
+		return nil, nil
+	}
+
+	usedKey := a.usedPrefix() + ip.String()
+	current, used, err := GetValue(a.kv, usedKey)
+	if err != nil {
+		return nil, err
+	}
+	cmp := store.Absent(usedKey)
+	if used {
+		//The previous container of the pod may still run
+		held := ParseAllocation(current)
+		if !held.Held || held.Pod != owner.Pod {
+			return nil, nil
+		}
+		cmp = store.ValueEquals(usedKey, current)
+	}
+
+	ok, err = a.kv.Txn([]store.Cmp{cmp}, []store.Op{
+		store.OpPut(usedKey, owner.String(), a.opts...),
+		store.OpPut(a.containerKey(owner), ip.String(), a.opts...),
+		store.OpPut(a.podKey(owner.Pod), ip.String(), a.opts...),
+	}, nil)
+	if err != nil || !ok {
+		//Another ADD took the IP, so the pod gets a new one
+		return nil, err
+	}
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: a.subnet.Mask}, nil
+}
+
+// Allocate claims the next free address for owner, or the sticky IP of
+// its pod
+func (a *Allocator) Allocate(owner Allocation) (*net.IPNet, error) {
+	if ipnet, err := a.allocated(owner); err != nil || ipnet != nil {
+		return ipnet, err
+	}
+	if owner.Pod != "" {
+		if ipnet, err := a.reclaim(owner); err != nil || ipnet != nil {
+			return ipnet, err
+		}
+	}
+
+	ipv6 := a.subnet.IP.To4() == nil
+	first, last := a.bounds()
+	size := new(big.Int).Sub(last, first)
+	size.Add(size, big.NewInt(1))
+
+	used, err := GetKeyValuesWithPrefix(a.kv, a.usedPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	cur := new(big.Int).Set(first)
+	lastReserved, _, err := GetValue(a.kv, a.prefix+"lastReserved")
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(lastReserved); ip != nil && a.subnet.Contains(ip) {
+		cur = new(big.Int).Add(IPToBigInt(ip), big.NewInt(1))
+		if cur.Cmp(first) < 0 || cur.Cmp(last) > 0 {
+			cur.Set(first)
+		}
+	}
+
+	//Excluded networks are skipped at once, so only the rest of the pool is
+	//ever checked
+	excluded := a.excludedRanges(first, last)
+	pool := new(big.Int).Set(size)
+	for _, r := range excluded {
+		pool.Sub(pool, new(big.Int).Sub(r[1], r[0]))
+		pool.Sub(pool, big.NewInt(1))
+	}
+
+	//At most taken addresses are unavailable, so if there is a free address
+	//we find it within one more step than that, unless we wrap around first.
+	taken := int64(len(used) + len(a.reserved))
+	for checked := int64(0); checked <= taken; checked++ {
+		if pool.IsInt64() && checked >= pool.Int64() {
+			break
+		}
+
+		for i := 0; i < len(excluded); i++ {
+			if cur.Cmp(excluded[i][0]) >= 0 && cur.Cmp(excluded[i][1]) <= 0 {
+				cur.Add(excluded[i][1], big.NewInt(1))
+				if cur.Cmp(last) > 0 {
+					cur.Set(first)
+					i = -1
+				}
+			}
+		}
+
+		ip := BigIntToIP(cur, ipv6)
+		cur.Add(cur, big.NewInt(1))
+		if cur.Cmp(last) > 0 {
+			cur.Set(first)
+		}
+
+		if _, ok := used[a.usedPrefix()+ip.String()]; ok || a.reserved[ip.String()] {
+			continue
+		}
+		ok, err := PutValuesIfAbsent(a.kv, map[string]string{
+			a.usedPrefix() + ip.String(): owner.String(),
+			a.containerKey(owner):        ip.String(),
+		}, a.opts...)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			//Either another ADD took the IP since we listed the used
+			//addresses, or a concurrent ADD for the same owner won
+			if ipnet, err := a.allocated(owner); err != nil || ipnet != nil {
+				return ipnet, err
+			}
+			taken++
+			continue
+		}
+
+		if err := PutValue(a.kv, a.prefix+"lastReserved", ip.String()); err != nil {
+			return nil, err
+		}
+		if owner.Pod != "" {
+			if err := PutValue(a.kv, a.podKey(owner.Pod), ip.String(), a.opts...); err != nil {
+				return nil, err
+			}
+		}
+		return &net.IPNet{IP: ip, Mask: a.subnet.Mask}, nil
+	}
+	return nil, ErrPoolExhausted
+}
+
+// indexedMarker is set under the prefix of an allocator once every
+// allocation it holds is in the containers index
+const indexedMarker = "indexed"
+
+// Release frees the IP allocated to owner, if any. Allocations made before
+// the containers index existed are found by scanning the used addresses.
+func (a *Allocator) Release(owner Allocation) error {
+	containerKey := a.containerKey(owner)
+	ip, ok, err := GetValue(a.kv, containerKey)
+	if err != nil {
+		return err
+	}
+	if ok {
+		//Only free the IP if it still belongs to the owner, whatever node
+		//it was allocated from
+		usedKey := a.usedPrefix() + ip
+		used, err := a.kv.Get(usedKey)
+		if err != nil {
+			return err
+		}
+		if used == nil || !owner.Owns(used.Value) {
+			return DeleteKey(a.kv, containerKey)
+		}
+		if stored := ParseAllocation(used.Value); stored.Pod != "" && a.hold > 0 {
+			return a.holdIP(stored, ip, used.ModRevision)
+		}
+		_, err = a.kv.Txn(
+			[]store.Cmp{store.ModRevisionEquals(usedKey, used.ModRevision)},
+			[]store.Op{store.OpDelete(usedKey), store.OpDelete(containerKey)},
+			[]store.Op{store.OpDelete(containerKey)})
+		return err
+	}
+
+	//DEL may run again, or for a container that got no IP, so a missing
+	//allocation is not an error. The used addresses are only scanned until
+	//no allocation made before the containers index is left.
+	marker := a.prefix + indexedMarker
+	_, indexed, err := GetValue(a.kv, marker)
+	if err != nil || indexed {
+		return err
+	}
+	used, err := GetKeyValuesWithPrefix(a.kv, a.usedPrefix())
+	if err != nil {
+		return err
+	}
+	legacy := 0
+	for k, v := range used {
+		if strings.HasPrefix(v, "{") {
+			continue
+		}
+		if v == owner.ContainerID {
+			return DeleteKey(a.kv, k)
+		}
+		legacy++
+	}
+	if legacy == 0 {
+		return PutValue(a.kv, marker, "true")
+	}
+	return nil
+}
+
+// holdIP keeps ip for the pod of owner under a lease of the hold time,
+// unless the pod moved to another IP meanwhile
+func (a *Allocator) holdIP(owner Allocation, ip string, revision int64) error {
+	usedKey := a.usedPrefix() + ip
+	containerKey := a.containerKey(owner)
+	pod, ok, err := GetValue(a.kv, a.podKey(owner.Pod))
+	if err != nil {
+		return err
+	}
+
+	free := []store.Op{store.OpDelete(usedKey), store.OpDelete(containerKey)}
+	if !ok || pod != ip {
+		_, err := a.kv.Txn([]store.Cmp{store.ModRevisionEquals(usedKey, revision)}, free, []store.Op{store.OpDelete(containerKey)})
+		return err
+	}
+
+	lease, err := a.kv.Grant(a.hold)
+	if err != nil {
+		return err
+	}
+	held := owner
+	held.Held = true
+	_, err = a.kv.Txn(
+		[]store.Cmp{store.ModRevisionEquals(usedKey, revision)},
+		[]store.Op{
+			store.OpPut(usedKey, held.String(), store.WithLease(lease)),
+			store.OpPut(a.podKey(owner.Pod), ip, store.WithLease(lease)),
+			store.OpDelete(containerKey),
+		},
+		[]store.Op{store.OpDelete(containerKey)})
+	return err
+}
+
+// Check verifies that ip is still allocated to owner
+func (a *Allocator) Check(owner Allocation, ip net.IP) error {
+	indexed, ok, err := GetValue(a.kv, a.containerKey(owner))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("There aren't any allocation for %s", owner)
+	}
+	if !net.ParseIP(indexed).Equal(ip) {
+		return fmt.Errorf("%s holds %s instead of %s", owner, indexed, ip)
+	}
+
+	value, ok, err := GetValue(a.kv, a.usedPrefix()+indexed)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s of %s isn't marked as used", indexed, owner)
+	}
+	if !owner.Owns(value) {
+		return fmt.Errorf("%s is now owned by %s", indexed, ParseAllocation(value))
+	}
+	return nil
+}
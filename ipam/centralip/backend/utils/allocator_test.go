@@ -0,0 +1,218 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/etcdtest"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const allocatorPrefix = ETCDPrefix + "allocator-test/"
+
+var etcdURL string
+
+func TestMain(m *testing.M) {
+	os.Exit(etcdtest.Main(m, &etcdURL))
+}
+
+// testStores returns a file store and an etcd store to run a test against
+func testStores(t *testing.T) map[string]store.KV {
+	dir, err := ioutil.TempDir("", "centralip")
+	assert.NoError(t, err)
+	fileStore, err := Connect(&IPMConfig{Store: "file", StorePath: filepath.Join(dir, "store.json")})
+	assert.NoError(t, err)
+	etcdStore, err := Connect(&IPMConfig{ETCDURL: etcdURL})
+	assert.NoError(t, err)
+	return map[string]store.KV{"file": fileStore, "etcd": etcdStore}
+}
+
+func TestAllocator(t *testing.T) {
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testAllocator(t, kv)
+		})
+		kv.Close()
+	}
+}
+
+func testAllocator(t *testing.T, kv store.KV) {
+	err := kv.DeletePrefix(allocatorPrefix)
+	assert.NoError(t, err)
+
+	_, subnet, _ := net.ParseCIDR("10.126.0.0/29")
+	gateway := net.ParseIP("10.126.0.1")
+	allocator := NewAllocator(kv, subnet, allocatorPrefix, gateway)
+
+	t.Run("sequential", func(t *testing.T) {
+		for i, expected := range []string{"10.126.0.2", "10.126.0.3", "10.126.0.4", "10.126.0.5", "10.126.0.6"} {
+			ipnet, err := allocator.Allocate(Allocation{ContainerID: fmt.Sprintf("pod%d", i), IfName: "eth0"})
+			assert.NoError(t, err)
+			assert.Equal(t, expected+"/29", ipnet.String())
+		}
+	})
+	t.Run("same owner", func(t *testing.T) {
+		ipnet, err := allocator.Allocate(Allocation{ContainerID: "pod1", IfName: "eth0"})
+		assert.NoError(t, err)
+		assert.Equal(t, "10.126.0.3", ipnet.IP.String())
+	})
+	t.Run("check", func(t *testing.T) {
+		owner := Allocation{ContainerID: "pod0", IfName: "eth0"}
+		assert.NoError(t, allocator.Check(owner, net.ParseIP("10.126.0.2")))
+		assert.Error(t, allocator.Check(owner, net.ParseIP("10.126.0.3")))
+		assert.Error(t, allocator.Check(Allocation{ContainerID: "pod9", IfName: "eth0"}, net.ParseIP("10.126.0.2")))
+
+		other := Allocation{ContainerID: "other", IfName: "eth0"}
+		assert.NoError(t, PutValue(kv, allocatorPrefix+"used/10.126.0.2", other.String()))
+		assert.Error(t, allocator.Check(owner, net.ParseIP("10.126.0.2")))
+		assert.NoError(t, PutValue(kv, allocatorPrefix+"used/10.126.0.2", owner.String()))
+	})
+	t.Run("exhausted", func(t *testing.T) {
+		_, err := allocator.Allocate(Allocation{ContainerID: "pod1", IfName: "eth1"})
+		assert.Equal(t, ErrPoolExhausted, err)
+	})
+	t.Run("release", func(t *testing.T) {
+		assert.NoError(t, allocator.Release(Allocation{ContainerID: "pod1", IfName: "eth0"}))
+		//DEL runs again when the runtime retries it
+		assert.NoError(t, allocator.Release(Allocation{ContainerID: "pod1", IfName: "eth0"}))
+		_, indexed, err := GetValue(kv, allocatorPrefix+indexedMarker)
+		assert.NoError(t, err)
+		assert.True(t, indexed)
+
+		ipnet, err := allocator.Allocate(Allocation{ContainerID: "pod1", IfName: "eth1"})
+		assert.NoError(t, err)
+		assert.Equal(t, "10.126.0.3", ipnet.IP.String())
+	})
+	t.Run("range and exclude", func(t *testing.T) {
+		_, subnet, _ := net.ParseCIDR("10.126.1.0/24")
+		_, excluded, _ := net.ParseCIDR("10.126.1.12/31")
+		allocator := NewAllocator(kv, subnet, allocatorPrefix+"range/").
+			WithRange(net.ParseIP("10.126.1.10"), net.ParseIP("10.126.1.14")).
+			WithExclude(excluded)
+
+		for i, expected := range []string{"10.126.1.10", "10.126.1.11", "10.126.1.14"} {
+			ipnet, err := allocator.Allocate(Allocation{ContainerID: fmt.Sprintf("pod%d", i), IfName: "eth0"})
+			assert.NoError(t, err)
+			assert.Equal(t, expected, ipnet.IP.String())
+		}
+		_, err := allocator.Allocate(Allocation{ContainerID: "pod3", IfName: "eth0"})
+		assert.Equal(t, ErrPoolExhausted, err)
+	})
+	t.Run("large IPv6 exclude", func(t *testing.T) {
+		_, subnet, _ := net.ParseCIDR("fd00:126::/64")
+		_, excluded, _ := net.ParseCIDR("fd00:126::/96")
+		allocator := NewAllocator(kv, subnet, allocatorPrefix+"v6exclude/").WithExclude(excluded)
+
+		expected := new(big.Int).Lsh(big.NewInt(1), 64)
+		expected.Sub(expected, new(big.Int).Lsh(big.NewInt(1), 32))
+		assert.Equal(t, expected.String(), allocator.Size().String())
+		for i, expected := range []string{"fd00:126::1:0:0", "fd00:126::1:0:1"} {
+			ipnet, err := allocator.Allocate(Allocation{ContainerID: fmt.Sprintf("pod%d", i), IfName: "eth0"})
+			assert.NoError(t, err)
+			assert.Equal(t, expected, ipnet.IP.String())
+		}
+	})
+	t.Run("release legacy allocation", func(t *testing.T) {
+		prefix := allocatorPrefix + "legacy/"
+		allocator := NewAllocator(kv, subnet, prefix)
+		assert.NoError(t, PutValue(kv, prefix+"used/10.126.0.6", "legacy-pod"))
+		assert.NoError(t, PutValue(kv, prefix+"used/10.126.0.7", "legacy-pod2"))
+		assert.NoError(t, allocator.Release(Allocation{ContainerID: "legacy-pod", IfName: "eth0"}))
+
+		used, err := GetKeyValuesWithPrefix(kv, prefix+"used/")
+		assert.NoError(t, err)
+		assert.NotContains(t, used, prefix+"used/10.126.0.6")
+
+		//The scan goes on while a legacy allocation is left
+		assert.NoError(t, allocator.Release(Allocation{ContainerID: "gone", IfName: "eth0"}))
+		_, indexed, err := GetValue(kv, prefix+indexedMarker)
+		assert.NoError(t, err)
+		assert.False(t, indexed)
+		assert.NoError(t, allocator.Release(Allocation{ContainerID: "legacy-pod2", IfName: "eth0"}))
+		assert.NoError(t, allocator.Release(Allocation{ContainerID: "legacy-pod2", IfName: "eth0"}))
+		_, indexed, err = GetValue(kv, prefix+indexedMarker)
+		assert.NoError(t, err)
+		assert.True(t, indexed)
+	})
+}
+
+func TestSticky(t *testing.T) {
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testSticky(t, kv, name == "file")
+		})
+		kv.Close()
+	}
+}
+
+func testSticky(t *testing.T, kv store.KV, expire bool) {
+	prefix := allocatorPrefix + "sticky/"
+	assert.NoError(t, kv.DeletePrefix(prefix))
+
+	_, subnet, _ := net.ParseCIDR("10.126.2.0/24")
+	allocator := NewAllocator(kv, subnet, prefix).WithHold(1)
+	first := Allocation{ContainerID: "c1", IfName: "eth0", Pod: "default/web-0"}
+	ipnet, err := allocator.Allocate(first)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.126.2.1", ipnet.IP.String())
+	assert.NoError(t, allocator.Release(first))
+
+	used, ok, err := GetValue(kv, prefix+"used/10.126.2.1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, ParseAllocation(used).Held)
+
+	//Another pod doesn't get the held IP
+	other := Allocation{ContainerID: "c2", IfName: "eth0", Pod: "default/web-1"}
+	ipnet, err = allocator.Allocate(other)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.126.2.2", ipnet.IP.String())
+
+	//The next container of the pod gets it back
+	second := Allocation{ContainerID: "c3", IfName: "eth0", Pod: "default/web-0"}
+	ipnet, err = allocator.Allocate(second)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.126.2.1", ipnet.IP.String())
+	assert.NoError(t, allocator.Check(second, ipnet.IP))
+	assert.Error(t, allocator.Check(first, ipnet.IP))
+
+	//Without a hold, the IP is freed
+	assert.NoError(t, NewAllocator(kv, subnet, prefix).Release(other))
+	_, ok, err = GetValue(kv, prefix+"used/10.126.2.2")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	if !expire {
+		return
+	}
+	t.Run("expire", func(t *testing.T) {
+		assert.NoError(t, allocator.Release(second))
+		time.Sleep(1100 * time.Millisecond)
+		_, ok, err := GetValue(kv, prefix+"used/10.126.2.1")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		_, ok, err = GetValue(kv, prefix+"pods/default/web-0")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"sort"
+	"strings"
+)
+
+// BackupVersion is the version of the Backup documents written by Export
+const BackupVersion = 1
+
+// Backup is the whole state of a network: its node subnets, gateways and
+// used IPs. Keys are relative to the prefix of the network, so a backup
+// can be restored under another network name.
+type Backup struct {
+	Version  int               `json:"version"`
+	Name     string            `json:"name"`
+	Networks []string          `json:"networks"`
+	Keys     map[string]string `json:"keys"`
+}
+
+// transientKey reports whether a key only makes sense in the store it was
+// read from: leases are granted again by the nodes, orphan marks by the
+// next reconcile, and failure counts start over
+func transientKey(key string) bool {
+	key = strings.TrimPrefix(key, "ipv6/")
+	return strings.HasPrefix(key, "leases/") || strings.HasPrefix(key, "orphans/") ||
+		strings.HasPrefix(key, "failures/")
+}
+
+func backupNetworks(families []*IPMConfig) []string {
+	var networks []string
+	for _, config := range families {
+		networks = append(networks, config.Network)
+	}
+	return networks
+}
+
+// Export returns the state of the network whose IP families are families,
+// as returned by IPMConfig.Families
+func Export(kv store.KV, families []*IPMConfig) (*Backup, error) {
+	prefix := families[0].KeyPrefix()
+	keyValues, err := GetKeyValuesWithPrefix(kv, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	backup := &Backup{
+		Version:  BackupVersion,
+		Name:     families[0].Name,
+		Networks: backupNetworks(families),
+		Keys:     make(map[string]string),
+	}
+	for k, v := range keyValues {
+		key := strings.TrimPrefix(k, prefix)
+		if !transientKey(key) {
+			backup.Keys[key] = v
+		}
+	}
+	return backup, nil
+}
+
+// Import writes the keys of backup into the network whose IP families are
+// families. Keys already holding the same value are skipped, so an
+// interrupted import can run again, and nothing is written if any key
+// holds another value. It returns the number of keys written.
+func Import(kv store.KV, families []*IPMConfig, backup *Backup) (int, error) {
+	if backup.Version != BackupVersion {
+		return 0, fmt.Errorf("Unsupport backup version %d", backup.Version)
+	}
+	networks := backupNetworks(families)
+	if strings.Join(backup.Networks, ",") != strings.Join(networks, ",") {
+		return 0, fmt.Errorf("The backup of %s doesn't match the networks %s",
+			strings.Join(backup.Networks, ","), strings.Join(networks, ","))
+	}
+
+	prefix := families[0].KeyPrefix()
+	existing, err := GetKeyValuesWithPrefix(kv, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys, conflicts []string
+	for key, value := range backup.Keys {
+		current, ok := existing[prefix+key]
+		switch {
+		case !ok:
+			keys = append(keys, key)
+		case current != value:
+			conflicts = append(conflicts, key)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return 0, fmt.Errorf("The network %s already holds other values for %s", families[0].Name, strings.Join(conflicts, ", "))
+	}
+
+	sort.Strings(keys)
+	for i, key := range keys {
+		if err := PutValue(kv, prefix+key, backup.Keys[key]); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	source := &IPMConfig{IPType: "node", Network: "10.134.0.0/16", Name: "backup-source"}
+	target := &IPMConfig{IPType: "node", Network: "10.134.0.0/16", Name: "backup-target"}
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, kv.DeletePrefix(source.KeyPrefix()))
+			assert.NoError(t, kv.DeletePrefix(target.KeyPrefix()))
+			for k, v := range map[string]string{
+				"node/host1":                    "10.134.1.0/24",
+				"node/subnets/10.134.1.0/24":    "host1",
+				"node/host1/gateway":            "10.134.1.1",
+				"node/host1/used/10.134.1.2":    Allocation{ContainerID: "c1", IfName: "eth0", Node: "host1"}.String(),
+				"node/host1/containers/c1/eth0": "10.134.1.2",
+				"leases/host1":                  "1234",
+				"orphans/10.134.1.2":            "c1",
+			} {
+				assert.NoError(t, PutValue(kv, source.KeyPrefix()+k, v))
+			}
+
+			backup, err := Export(kv, []*IPMConfig{source})
+			assert.NoError(t, err)
+			assert.Equal(t, BackupVersion, backup.Version)
+			assert.Len(t, backup.Keys, 5)
+			assert.NotContains(t, backup.Keys, "leases/host1")
+
+			data, err := json.Marshal(backup)
+			assert.NoError(t, err)
+			restored := &Backup{}
+			assert.NoError(t, json.Unmarshal(data, restored))
+
+			n, err := Import(kv, []*IPMConfig{target}, restored)
+			assert.NoError(t, err)
+			assert.Equal(t, 5, n)
+			used, err := UsedIPs(kv, target)
+			assert.NoError(t, err)
+			assert.Len(t, used, 1)
+			assert.Equal(t, "c1", used[0].Owner.ContainerID)
+
+			//Importing again writes nothing
+			n, err = Import(kv, []*IPMConfig{target}, restored)
+			assert.NoError(t, err)
+			assert.Equal(t, 0, n)
+
+			assert.NoError(t, PutValue(kv, target.KeyPrefix()+"node/host1/gateway", "10.134.1.254"))
+			_, err = Import(kv, []*IPMConfig{target}, restored)
+			assert.Error(t, err)
+
+			other := &IPMConfig{IPType: "node", Network: "10.135.0.0/16", Name: "backup-target"}
+			_, err = Import(kv, []*IPMConfig{other}, restored)
+			assert.Error(t, err)
+		})
+		kv.Close()
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"strconv"
+	"strings"
+)
+
+func failurePrefix(config *IPMConfig) string {
+	return config.KeyPrefix() + "failures/"
+}
+
+// RecordFailure counts a failed allocation on node in failures/<node>, so
+// the metrics show it. The plugin exits after each ADD, so the count has to
+// live in the store.
+func RecordFailure(kv store.KV, config *IPMConfig, node string) error {
+	key := failurePrefix(config) + node
+	//Concurrent ADDs may fail at the same time, so retry the increment
+	for i := 0; i < 5; i++ {
+		value, ok, err := GetValue(kv, key)
+		if err != nil {
+			return err
+		}
+		count, _ := strconv.ParseInt(value, 10, 64)
+		cmp := store.Absent(key)
+		if ok {
+			cmp = store.ValueEquals(key, value)
+		}
+		ok, err = kv.Txn([]store.Cmp{cmp}, []store.Op{store.OpPut(key, strconv.FormatInt(count+1, 10))}, nil)
+		if err != nil || ok {
+			return err
+		}
+	}
+	return fmt.Errorf("Failed to count the allocation failure of %s", node)
+}
+
+// Failures returns the number of failed allocations of each node
+func Failures(kv store.KV, config *IPMConfig) (map[string]int64, error) {
+	keyValues, err := GetKeyValuesWithPrefix(kv, failurePrefix(config))
+	if err != nil {
+		return nil, err
+	}
+	failures := make(map[string]int64)
+	for k, v := range keyValues {
+		count, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid failure count %q of %s", v, k)
+		}
+		failures[strings.TrimPrefix(k, failurePrefix(config))] = count
+	}
+	return failures, nil
+}
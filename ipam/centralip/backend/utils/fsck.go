@@ -0,0 +1,328 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"net"
+	"sort"
+	"strings"
+)
+
+// The classes of inconsistencies found by Fsck
+const (
+	// ProblemInvalidSubnet is a node/<host> key that doesn't hold a CIDR
+	ProblemInvalidSubnet = "invalid-subnet"
+	// ProblemDuplicateOwner is a subnet overlapping the subnet of another
+	// node
+	ProblemDuplicateOwner = "duplicate-subnet-owner"
+	// ProblemSubnetOwner is a node/subnets/<cidr> key pointing at a node
+	// that doesn't hold the subnet
+	ProblemSubnetOwner = "subnet-owner-mismatch"
+	// ProblemSubnetNotIndexed is a subnet missing from node/subnets/
+	ProblemSubnetNotIndexed = "subnet-not-indexed"
+	// ProblemGateway is a gateway key of a node without a subnet
+	ProblemGateway = "gateway-without-subnet"
+	// ProblemGatewayOutside is a gateway key outside the subnet of its node
+	ProblemGatewayOutside = "gateway-outside-subnet"
+	// ProblemIPOutsideSubnet is a used IP outside the subnet of its node,
+	// or outside the network in the cluster mode
+	ProblemIPOutsideSubnet = "ip-outside-subnet"
+	// ProblemContainerIndex is a containers/ key pointing at an IP its
+	// container doesn't own
+	ProblemContainerIndex = "stale-container-index"
+)
+
+// Problem is an inconsistent key, and how Fsck repairs it: Action is
+// "delete", or "put" with the value Repair
+type Problem struct {
+	Class  string `json:"class"`
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Detail string `json:"detail"`
+	Action string `json:"action"`
+	Repair string `json:"repair,omitempty"`
+}
+
+// FsckReport lists the problems of an IP family of a network, found at
+// Revision of the store
+type FsckReport struct {
+	Network  string    `json:"network"`
+	CIDR     string    `json:"cidr"`
+	Revision int64     `json:"revision"`
+	Problems []Problem `json:"problems"`
+	Repaired bool      `json:"repaired"`
+}
+
+// fsck checks a copy of the keys of a network. Each repair is applied to
+// the copy, so the later checks see the repaired state, and the changes
+// are written back together.
+type fsck struct {
+	config   *IPMConfig
+	original map[string]store.KeyValue
+	keys     map[string]string
+	problems []Problem
+}
+
+func (f *fsck) remove(class, key, detail string) {
+	f.problems = append(f.problems, Problem{Class: class, Key: key, Value: f.keys[key], Detail: detail, Action: "delete"})
+	delete(f.keys, key)
+}
+
+func (f *fsck) put(class, key, value, detail string) {
+	f.problems = append(f.problems, Problem{Class: class, Key: key, Value: f.keys[key], Detail: detail, Action: "put", Repair: value})
+	f.keys[key] = value
+}
+
+// children returns the keys under prefix, sorted, without the prefix
+func (f *fsck) children(prefix string) []string {
+	var children []string
+	for k := range f.keys {
+		if strings.HasPrefix(k, prefix) {
+			children = append(children, strings.TrimPrefix(k, prefix))
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return IPToBigInt(a.IP).Cmp(lastIP(b)) <= 0 && IPToBigInt(b.IP).Cmp(lastIP(a)) <= 0
+}
+
+// checkOwners checks the subnets of the nodes, or namespaces, and the keys
+// depending on them
+func (f *fsck) checkOwners() {
+	prefix := nodePrefix(f.config)
+	indexPrefix := subnetPrefix(f.config)
+
+	subnets := make(map[string]*net.IPNet)
+	var owners []string
+	for _, rest := range f.children(prefix) {
+		if strings.Contains(rest, "/") {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(f.keys[prefix+rest])
+		if err != nil {
+			f.remove(ProblemInvalidSubnet, prefix+rest, fmt.Sprintf("%s holds %q, which is not a subnet", rest, f.keys[prefix+rest]))
+			continue
+		}
+		subnets[rest] = subnet
+		owners = append(owners, rest)
+	}
+	usedCount := func(owner string) int {
+		return len(f.children(prefix + owner + "/used/"))
+	}
+
+	//Of two overlapping subnets, keep the one the index points at, then
+	//the one with the most IPs
+	for i, a := range owners {
+		for _, b := range owners[i+1:] {
+			if subnets[a] == nil || subnets[b] == nil || !overlaps(subnets[a], subnets[b]) {
+				continue
+			}
+			keep, drop := a, b
+			switch {
+			case f.keys[indexPrefix+subnets[b].String()] == b && f.keys[indexPrefix+subnets[a].String()] != a:
+				keep, drop = b, a
+			case f.keys[indexPrefix+subnets[a].String()] != a && usedCount(b) > usedCount(a):
+				keep, drop = b, a
+			}
+			f.remove(ProblemDuplicateOwner, prefix+drop,
+				fmt.Sprintf("%s holds %s, which overlaps %s of %s", drop, subnets[drop], subnets[keep], keep))
+			subnets[drop] = nil
+		}
+	}
+
+	holder := func(cidr string) string {
+		for _, owner := range owners {
+			if subnets[owner] != nil && subnets[owner].String() == cidr {
+				return owner
+			}
+		}
+		return ""
+	}
+	for _, cidr := range f.children(indexPrefix) {
+		host := f.keys[indexPrefix+cidr]
+		if subnets[host] != nil && subnets[host].String() == cidr {
+			continue
+		}
+		key := indexPrefix + cidr
+		if owner := holder(cidr); owner != "" {
+			f.put(ProblemSubnetOwner, key, owner, fmt.Sprintf("%s is registered to %s, but held by %s", cidr, host, owner))
+			continue
+		}
+
+		//The node lost its subnet key but still has IPs in the subnet
+		_, subnet, err := net.ParseCIDR(cidr)
+		inSubnet := 0
+		if err == nil {
+			for _, ip := range f.children(prefix + host + "/used/") {
+				if subnet.Contains(net.ParseIP(ip)) {
+					inSubnet++
+				}
+			}
+		}
+		if _, held := subnets[host]; !held && inSubnet > 0 {
+			f.put(ProblemSubnetOwner, prefix+host, cidr, fmt.Sprintf("%s is registered to %s, which holds no subnet but %d IPs in it", cidr, host, inSubnet))
+			subnets[host] = subnet
+			owners = append(owners, host)
+			continue
+		}
+		f.remove(ProblemSubnetOwner, key, fmt.Sprintf("%s is registered to %s, which doesn't hold it", cidr, host))
+	}
+
+	sort.Strings(owners)
+	for _, owner := range owners {
+		if subnets[owner] == nil {
+			continue
+		}
+		key := indexPrefix + subnets[owner].String()
+		if _, ok := f.keys[key]; !ok {
+			f.put(ProblemSubnetNotIndexed, key, owner, fmt.Sprintf("%s of %s is not registered in subnets", subnets[owner], owner))
+		}
+	}
+
+	//Whatever lives under a node without a subnet is left behind
+	for _, rest := range f.children(prefix) {
+		parts := strings.SplitN(rest, "/", 3)
+		if len(parts) < 2 || prefix+parts[0]+"/" == indexPrefix {
+			continue
+		}
+		owner, subnet := parts[0], subnets[parts[0]]
+		switch {
+		case parts[1] == "gateway" && len(parts) == 2:
+			gw := net.ParseIP(f.keys[prefix+rest])
+			if subnet == nil {
+				f.remove(ProblemGateway, prefix+rest, fmt.Sprintf("%s has a gateway but no subnet", owner))
+			} else if gw == nil || !subnet.Contains(gw) {
+				f.remove(ProblemGatewayOutside, prefix+rest, fmt.Sprintf("the gateway of %s is outside its subnet %s", owner, subnet))
+			}
+		case parts[1] == "used" && len(parts) == 3:
+			ip := net.ParseIP(parts[2])
+			if subnet == nil {
+				f.remove(ProblemIPOutsideSubnet, prefix+rest, fmt.Sprintf("%s is allocated on %s, which holds no subnet", parts[2], owner))
+			} else if ip == nil || !subnet.Contains(ip) {
+				f.remove(ProblemIPOutsideSubnet, prefix+rest, fmt.Sprintf("%s is outside the subnet %s of %s", parts[2], subnet, owner))
+			}
+		}
+	}
+}
+
+// checkCluster checks the IPs of the cluster mode against the network
+func (f *fsck) checkCluster() {
+	prefix := f.config.KeyPrefix() + "cluster/used/"
+	_, network, err := net.ParseCIDR(f.config.Network)
+	if err != nil {
+		return
+	}
+	for _, rest := range f.children(prefix) {
+		if ip := net.ParseIP(rest); ip == nil || !network.Contains(ip) {
+			f.remove(ProblemIPOutsideSubnet, prefix+rest, fmt.Sprintf("%s is outside the network %s", rest, network))
+		}
+	}
+}
+
+// checkContainers drops the containers index entries whose IP isn't owned
+// by their container
+func (f *fsck) checkContainers() {
+	for _, key := range f.children("") {
+		i := strings.Index(key, "/containers/")
+		if i < 0 {
+			continue
+		}
+		parts := strings.Split(key[i+len("/containers/"):], "/")
+		if len(parts) != 2 {
+			continue
+		}
+		owner := Allocation{ContainerID: parts[0], IfName: parts[1]}
+		used, ok := f.keys[key[:i]+"/used/"+f.keys[key]]
+		if !ok || !owner.Owns(used) {
+			f.remove(ProblemContainerIndex, key, fmt.Sprintf("%s/%s doesn't own %s", parts[0], parts[1], f.keys[key]))
+		}
+	}
+}
+
+// DefaultMaxTxnOps is the default limit of etcd on the operations of a
+// transaction, set by its --max-txn-ops flag
+const DefaultMaxTxnOps = 128
+
+// Fsck finds the inconsistencies of the keys of the network, and repairs
+// them in one transaction if repair is set. The transaction fails if any
+// key it changes was written since it was read. Repairs needing more than
+// maxTxnOps operations or compares are refused, unless the store is a
+// file or maxTxnOps is 0.
+func Fsck(kv store.KV, config *IPMConfig, repair bool, maxTxnOps int) (*FsckReport, error) {
+	root := config.KeyPrefix() + "cluster/"
+	if config.IPType == "node" || config.IPType == "namespace" {
+		root = nodePrefix(config)
+	}
+	kvs, revision, err := kv.Range(root)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fsck{config: config, original: make(map[string]store.KeyValue), keys: make(map[string]string)}
+	for _, keyValue := range kvs {
+		f.original[keyValue.Key] = keyValue
+		f.keys[keyValue.Key] = keyValue.Value
+	}
+	if root == nodePrefix(config) {
+		f.checkOwners()
+	} else {
+		f.checkCluster()
+	}
+	f.checkContainers()
+
+	report := &FsckReport{Network: config.Name, CIDR: config.Network, Revision: revision, Problems: f.problems}
+	if !repair || len(f.problems) == 0 {
+		return report, nil
+	}
+
+	var cmps []store.Cmp
+	var ops []store.Op
+	for key, original := range f.original {
+		value, ok := f.keys[key]
+		switch {
+		case !ok:
+			cmps = append(cmps, store.ModRevisionEquals(key, original.ModRevision))
+			ops = append(ops, store.OpDelete(key))
+		case value != original.Value:
+			cmps = append(cmps, store.ModRevisionEquals(key, original.ModRevision))
+			ops = append(ops, store.OpPut(key, value, store.WithLease(original.Lease)))
+		}
+	}
+	for key, value := range f.keys {
+		if _, ok := f.original[key]; !ok {
+			cmps = append(cmps, store.Absent(key))
+			ops = append(ops, store.OpPut(key, value))
+		}
+	}
+
+	if config.Store != "file" && maxTxnOps > 0 && (len(ops) > maxTxnOps || len(cmps) > maxTxnOps) {
+		return report, fmt.Errorf("The repair of %s needs a transaction of %d operations, more than the %d allowed. Raise --max-txn-ops of etcd and -max-txn-ops of fsck, or repair the problems by hand first",
+			config.Network, len(ops), maxTxnOps)
+	}
+	ok, err := kv.Txn(cmps, ops, nil)
+	if err != nil {
+		return report, err
+	}
+	if !ok {
+		return report, fmt.Errorf("The keys of %s changed while checking them, run fsck again", config.Network)
+	}
+	report.Repaired = true
+	return report, nil
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+func problemClasses(report *FsckReport) map[string]string {
+	classes := make(map[string]string)
+	for _, p := range report.Problems {
+		classes[p.Key] = p.Class
+	}
+	return classes
+}
+
+func TestFsck(t *testing.T) {
+	config := &IPMConfig{
+		IPType:    "node",
+		Network:   "10.139.0.0/16",
+		SubnetLen: 24,
+		SubnetMin: "10.139.1.0",
+		SubnetMax: "10.139.9.0",
+		Name:      "fsck-test",
+	}
+	p := nodePrefix(config)
+	owner := func(id, node string) string {
+		return Allocation{ContainerID: id, IfName: "eth0", Node: node}.String()
+	}
+
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, kv.DeletePrefix(config.KeyPrefix()))
+			for k, v := range map[string]string{
+				//host1 is consistent but for an IP outside its subnet
+				"host1":                    "10.139.1.0/24",
+				"subnets/10.139.1.0/24":    "host1",
+				"host1/gateway":            "10.139.1.1",
+				"host1/used/10.139.1.2":    owner("c1", "host1"),
+				"host1/containers/c1/eth0": "10.139.1.2",
+				"host1/used/10.139.5.2":    owner("c2", "host1"),
+				"host1/containers/c2/eth0": "10.139.5.2",
+				"host1/containers/c9/eth0": "10.139.1.9",
+				//host2 duplicates the subnet of host1
+				"host2":                 "10.139.1.0/24",
+				"host2/used/10.139.1.3": owner("c3", "host2"),
+				//host3 isn't indexed, and the index of 10.139.4.0/24 is wrong
+				"host3":                 "10.139.3.0/24",
+				"subnets/10.139.4.0/24": "host3",
+				//host4 lost its subnet key but kept its IPs and index
+				"subnets/10.139.6.0/24": "host4",
+				"host4/used/10.139.6.2": owner("c4", "host4"),
+				//host5 is gone but left its gateway
+				"host5/gateway": "10.139.7.1",
+				//host3 has a gateway of another subnet
+				"host3/gateway": "10.139.8.1",
+			} {
+				assert.NoError(t, PutValue(kv, p+k, v))
+			}
+
+			report, err := Fsck(kv, config, false, DefaultMaxTxnOps)
+			assert.NoError(t, err)
+			assert.False(t, report.Repaired)
+			assert.Equal(t, map[string]string{
+				p + "host1/used/10.139.5.2":    ProblemIPOutsideSubnet,
+				p + "host1/containers/c2/eth0": ProblemContainerIndex,
+				p + "host1/containers/c9/eth0": ProblemContainerIndex,
+				p + "host2":                    ProblemDuplicateOwner,
+				p + "host2/used/10.139.1.3":    ProblemIPOutsideSubnet,
+				p + "subnets/10.139.3.0/24":    ProblemSubnetNotIndexed,
+				p + "subnets/10.139.4.0/24":    ProblemSubnetOwner,
+				p + "host4":                    ProblemSubnetOwner,
+				p + "host5/gateway":            ProblemGateway,
+				p + "host3/gateway":            ProblemGatewayOutside,
+			}, problemClasses(report))
+
+			//The repair doesn't fit in a transaction of 5 operations
+			_, err = Fsck(kv, config, true, 5)
+			assert.Error(t, err)
+
+			//Nothing changed without repair
+			_, ok, err := GetValue(kv, p+"host2")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			report, err = Fsck(kv, config, true, DefaultMaxTxnOps)
+			assert.NoError(t, err)
+			assert.True(t, report.Repaired)
+
+			subnets, err := NodeSubnets(kv, config)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{
+				"host1": "10.139.1.0/24",
+				"host3": "10.139.3.0/24",
+				"host4": "10.139.6.0/24",
+			}, subnets)
+			problems, err := CheckSubnets(kv, config)
+			assert.NoError(t, err)
+			assert.Empty(t, problems)
+
+			ips, err := UsedIPs(kv, config)
+			assert.NoError(t, err)
+			var allocated []string
+			for _, used := range ips {
+				allocated = append(allocated, used.IP.String())
+			}
+			sort.Strings(allocated)
+			assert.Equal(t, []string{"10.139.1.2", "10.139.6.2"}, allocated)
+
+			report, err = Fsck(kv, config, true, DefaultMaxTxnOps)
+			assert.NoError(t, err)
+			assert.Empty(t, report.Problems)
+		})
+		kv.Close()
+	}
+}
+
+func TestFsckCluster(t *testing.T) {
+	config := &IPMConfig{
+		IPType:  "cluster",
+		Network: "10.141.0.0/16",
+		Name:    "fsck-cluster-test",
+	}
+	p := config.KeyPrefix() + "cluster/"
+
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, kv.DeletePrefix(config.KeyPrefix()))
+			for k, v := range map[string]string{
+				"used/10.141.0.2":    Allocation{ContainerID: "c1", IfName: "eth0", Node: "host1"}.String(),
+				"containers/c1/eth0": "10.141.0.2",
+				"used/10.142.0.2":    Allocation{ContainerID: "c2", IfName: "eth0", Node: "host1"}.String(),
+				"containers/c2/eth0": "10.142.0.2",
+			} {
+				assert.NoError(t, PutValue(kv, p+k, v))
+			}
+
+			report, err := Fsck(kv, config, true, DefaultMaxTxnOps)
+			assert.NoError(t, err)
+			assert.True(t, report.Repaired)
+			assert.Equal(t, map[string]string{
+				p + "used/10.142.0.2":    ProblemIPOutsideSubnet,
+				p + "containers/c2/eth0": ProblemContainerIndex,
+			}, problemClasses(report))
+
+			_, ok, err := GetValue(kv, p+"containers/c1/eth0")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			_, ok, err = GetValue(kv, p+"used/10.142.0.2")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		})
+		kv.Close()
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// HostLocalDir returns the directory where host-local keeps the IPs of the
+// CNI network name
+func HostLocalDir(name string) string {
+	return filepath.Join("/var/lib/cni/networks", name)
+}
+
+// hostLocalIP is an IP reserved by host-local. Older versions only stored
+// the container ID, without the interface.
+type hostLocalIP struct {
+	ip          net.IP
+	containerID string
+	ifName      string
+}
+
+// readHostLocal returns the IPs of the network of config reserved in dir,
+// and the last one reserved in it
+func readHostLocal(config *IPMConfig, dir string) ([]hostLocalIP, net.IP, error) {
+	_, network, err := net.ParseCIDR(config.Network)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid network %q: %v", config.Network, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ips []hostLocalIP
+	var last net.IP
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		//host-local keeps one last_reserved_ip.<range> per range
+		if strings.HasPrefix(f.Name(), "last_reserved_ip") {
+			if ip := net.ParseIP(strings.TrimSpace(string(data))); ip != nil && network.Contains(ip) {
+				last = ip
+			}
+			continue
+		}
+		ip := net.ParseIP(f.Name())
+		if ip == nil || !network.Contains(ip) {
+			continue
+		}
+
+		lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+		reserved := hostLocalIP{ip: ip, containerID: strings.TrimSpace(lines[0])}
+		if len(lines) > 1 {
+			reserved.ifName = strings.TrimSpace(lines[1])
+		}
+		if reserved.containerID == "" {
+			return nil, nil, fmt.Errorf("%s has no container ID", filepath.Join(dir, f.Name()))
+		}
+		ips = append(ips, reserved)
+	}
+	return ips, last, nil
+}
+
+// hostLocalSubnet returns the subnet of node holding ips, registering it
+// if the node has none yet
+func hostLocalSubnet(kv store.KV, config *IPMConfig, node string, ips []hostLocalIP) (*net.IPNet, error) {
+	nodePrefix := config.KeyPrefix() + "node/"
+	mask := net.CIDRMask(config.SubnetLen, config.subnetBits())
+	subnet := &net.IPNet{IP: ips[0].ip.Mask(mask), Mask: mask}
+
+	registered, ok, err := GetValue(kv, nodePrefix+node)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		_, subnet, err = net.ParseCIDR(registered)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, reserved := range ips {
+		if !subnet.Contains(reserved.ip) {
+			return nil, fmt.Errorf("%s is not in the subnet %s of %s", reserved.ip, subnet, node)
+		}
+	}
+	if ok {
+		return subnet, nil
+	}
+
+	if !config.InSubnetRanges(subnet) {
+		return nil, fmt.Errorf("The subnet %s of %s is not in the subnet ranges", subnet, node)
+	}
+	ok, err = PutValuesIfAbsent(kv, map[string]string{
+		nodePrefix + node:                         subnet.String(),
+		nodePrefix + "subnets/" + subnet.String(): node,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("The subnet %s is already registered by another node", subnet)
+	}
+	return subnet, nil
+}
+
+// ImportHostLocal seeds the allocations host-local reserved in dir on node,
+// so the containers keep their IPs when the network switches to centralip.
+// In the node mode the subnet holding the IPs is registered for node. It
+// returns the number of IPs imported.
+func ImportHostLocal(kv store.KV, config *IPMConfig, node, dir string) (int, error) {
+	ips, last, err := readHostLocal(config, dir)
+	if err != nil || len(ips) == 0 {
+		return 0, err
+	}
+
+	var prefix string
+	switch config.IPType {
+	case "cluster":
+		prefix = config.KeyPrefix() + "cluster/"
+	case "node":
+		if _, err := hostLocalSubnet(kv, config, node, ips); err != nil {
+			return 0, err
+		}
+		prefix = config.KeyPrefix() + "node/" + node + "/"
+	default:
+		return 0, fmt.Errorf("Unsupport IPM type %s for a host-local import", config.IPType)
+	}
+
+	//DEL has to scan the used IPs again for the bare container IDs
+	for _, reserved := range ips {
+		if reserved.ifName == "" {
+			if err := DeleteKey(kv, prefix+indexedMarker); err != nil {
+				return 0, err
+			}
+			break
+		}
+	}
+
+	imported := 0
+	for _, reserved := range ips {
+		usedKey := prefix + "used/" + reserved.ip.String()
+		keyValues := make(map[string]string)
+		//Without the interface, DEL finds the IP by its bare container ID
+		owner := Allocation{ContainerID: reserved.containerID, IfName: reserved.ifName, Node: node}
+		if reserved.ifName == "" {
+			keyValues[usedKey] = reserved.containerID
+		} else {
+			keyValues[usedKey] = owner.String()
+			keyValues[prefix+"containers/"+owner.ContainerID+"/"+owner.IfName] = reserved.ip.String()
+		}
+
+		ok, err := PutValuesIfAbsent(kv, keyValues)
+		if err != nil {
+			return imported, err
+		}
+		if ok {
+			imported++
+			continue
+		}
+		//An IP imported by a previous run is fine, one taken by another
+		//container is not
+		current, _, err := GetValue(kv, usedKey)
+		if err != nil {
+			return imported, err
+		}
+		if current != keyValues[usedKey] {
+			return imported, fmt.Errorf("%s is already allocated to %s", reserved.ip, ParseAllocation(current).ContainerID)
+		}
+	}
+
+	if last != nil {
+		if _, err := PutValueIfAbsent(kv, prefix+"lastReserved", last.String()); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
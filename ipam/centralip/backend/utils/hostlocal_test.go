@@ -0,0 +1,88 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func hostLocalDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "host-local")
+	assert.NoError(t, err)
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestImportHostLocal(t *testing.T) {
+	dir := hostLocalDir(t, map[string]string{
+		"10.136.3.2":         "c1\r\neth0",
+		"10.136.3.3":         "c2",
+		"fd00::2":            "c3\r\neth0",
+		"last_reserved_ip.0": "10.136.3.3",
+		"lock":               "",
+	})
+	defer os.RemoveAll(dir)
+
+	config := &IPMConfig{
+		IPType:    "node",
+		Network:   "10.136.0.0/16",
+		SubnetLen: 24,
+		SubnetMin: "10.136.1.0",
+		SubnetMax: "10.136.9.0",
+		Name:      "host-local-test",
+	}
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, kv.DeletePrefix(config.KeyPrefix()))
+
+			n, err := ImportHostLocal(kv, config, "host1", dir)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, n)
+
+			subnet, _, err := GetValue(kv, config.KeyPrefix()+"node/host1")
+			assert.NoError(t, err)
+			assert.Equal(t, "10.136.3.0/24", subnet)
+			used, err := UsedIPs(kv, config)
+			assert.NoError(t, err)
+			assert.Len(t, used, 2)
+
+			//The imported IPs are released by DEL
+			allocator := NewAllocator(kv, parseCIDRs("10.136.3.0/24")[0], config.KeyPrefix()+"node/host1/")
+			assert.NoError(t, allocator.Release(Allocation{ContainerID: "c1", IfName: "eth0"}))
+			assert.NoError(t, allocator.Release(Allocation{ContainerID: "c2", IfName: "eth0"}))
+			used, err = UsedIPs(kv, config)
+			assert.NoError(t, err)
+			assert.Empty(t, used)
+
+			t.Run("another node", func(t *testing.T) {
+				_, err := ImportHostLocal(kv, config, "host2", dir)
+				assert.Error(t, err)
+			})
+			t.Run("namespace mode", func(t *testing.T) {
+				namespace := *config
+				namespace.IPType = "namespace"
+				_, err := ImportHostLocal(kv, &namespace, "host1", dir)
+				assert.Error(t, err)
+			})
+		})
+		kv.Close()
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	LeaseModeReclaim = "reclaim"
+	LeaseModeReport  = "report"
+)
+
+// ValidateLease checks the lease settings of the network
+func ValidateLease(config *IPMConfig) error {
+	if config.LeaseTTL < 0 {
+		return fmt.Errorf("The leaseTTL should not be negative: %d", config.LeaseTTL)
+	}
+	if config.DeregisterExpiredNodes && (config.LeaseTTL == 0 || config.IPType != "node") {
+		return fmt.Errorf("deregisterExpiredNodes requires the node mode and a leaseTTL")
+	}
+	switch config.LeaseMode {
+	case "", LeaseModeReclaim, LeaseModeReport:
+		return nil
+	}
+	return fmt.Errorf("Unsupport leaseMode %q", config.LeaseMode)
+}
+
+func leasePrefix(config *IPMConfig) string {
+	return config.KeyPrefix() + "leases/"
+}
+
+// NodeLease returns the lease of the node, renewing it if it exists and
+// granting it otherwise. The key holding the lease ID is attached to the
+// lease itself, so it disappears when the node stops sending heartbeats.
+func NodeLease(kv store.KV, config *IPMConfig, node string) (store.LeaseID, error) {
+	if config.LeaseTTL == 0 {
+		return store.NoLease, nil
+	}
+
+	key := leasePrefix(config) + node
+	//A concurrent ADD on the node may grant the lease first, so try again
+	//to pick up its lease
+	for i := 0; i < 3; i++ {
+		value, ok, err := GetValue(kv, key)
+		if err != nil {
+			return store.NoLease, err
+		}
+
+		if ok {
+			id, err := strconv.ParseInt(value, 16, 64)
+			if err != nil {
+				return store.NoLease, fmt.Errorf("Invalid lease %q for node %s", value, node)
+			}
+
+			err = kv.KeepAlive(store.LeaseID(id))
+			if err == nil {
+				return store.LeaseID(id), nil
+			}
+			if err != store.ErrLeaseNotFound {
+				return store.NoLease, fmt.Errorf("Failed to renew the lease of node %s: %v", node, err)
+			}
+			//The lease expired after we read the key, which is gone with it
+			continue
+		}
+
+		id, err := kv.Grant(config.LeaseTTL)
+		if err != nil {
+			return store.NoLease, fmt.Errorf("Failed to grant a lease for node %s: %v", node, err)
+		}
+
+		ok, err = PutValueIfAbsent(kv, key, fmt.Sprintf("%x", int64(id)), store.WithLease(id))
+		if err != nil {
+			return store.NoLease, err
+		}
+		if ok {
+			return id, nil
+		}
+		kv.Revoke(id)
+	}
+	return store.NoLease, fmt.Errorf("Failed to acquire the lease of node %s", node)
+}
+
+// LeaseOpts returns the options attaching keys to the lease, which makes
+// the store delete them once the lease expires. In the report mode the
+// keys are kept and only listed by ExpiredKeys.
+func LeaseOpts(config *IPMConfig, id store.LeaseID) []store.OpOption {
+	if id == store.NoLease || config.LeaseMode == LeaseModeReport {
+		return nil
+	}
+	return []store.OpOption{store.WithLease(id)}
+}
+
+// ExpiredKeys returns the allocations and node subnets that belong to a
+// node without a live lease, mapped to that node. Those are the keys the
+// reclaim mode would have deleted.
+func ExpiredKeys(kv store.KV, config *IPMConfig) (map[string]string, error) {
+	keyValues, err := GetKeyValuesWithPrefix(kv, config.KeyPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	alive := make(map[string]bool)
+	for k := range keyValues {
+		if strings.HasPrefix(k, leasePrefix(config)) {
+			alive[strings.TrimPrefix(k, leasePrefix(config))] = true
+		}
+	}
+
+	expired := make(map[string]string)
+	for k, v := range keyValues {
+		var node string
+		switch {
+		case strings.HasPrefix(k, config.KeyPrefix()+"node/subnets/"):
+			node = v
+		case strings.HasPrefix(k, config.KeyPrefix()+"node/"), strings.HasPrefix(k, config.KeyPrefix()+"cluster/"),
+			strings.HasPrefix(k, config.KeyPrefix()+"namespace/"):
+			if strings.Contains(k, "/used/") {
+				node = ParseAllocation(v).Node
+			}
+		}
+		if node != "" && !alive[node] {
+			expired[k] = node
+		}
+	}
+	return expired, nil
+}
+
+// DeregisterExpiredNodes frees the subnets of the nodes without a live
+// lease that hold no IP, and returns those nodes. A node grants its lease
+// before registering a subnet, so the subnet of a node joining meanwhile
+// is never freed.
+func DeregisterExpiredNodes(kv store.KV, config *IPMConfig) ([]string, error) {
+	leases, err := GetKeyValuesWithPrefix(kv, leasePrefix(config))
+	if err != nil {
+		return nil, err
+	}
+	subnets, err := NodeSubnets(kv, config)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := UsedIPs(kv, config)
+	if err != nil {
+		return nil, err
+	}
+	busy := make(map[string]bool)
+	for _, used := range ips {
+		busy[used.Owner.Node] = true
+	}
+
+	var nodes []string
+	for host := range subnets {
+		if _, ok := leases[leasePrefix(config)+host]; ok || busy[host] {
+			continue
+		}
+		if err := DeregisterNode(kv, config, host); err != nil {
+			//The heartbeat of another node may have freed it first
+			if _, ok, _ := GetValue(kv, nodePrefix(config)+host); !ok {
+				continue
+			}
+			return nodes, err
+		}
+		nodes = append(nodes, host)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestValidateLease(t *testing.T) {
+	assert.NoError(t, ValidateLease(&IPMConfig{}))
+	assert.NoError(t, ValidateLease(&IPMConfig{LeaseTTL: 30, LeaseMode: LeaseModeReport}))
+	assert.Error(t, ValidateLease(&IPMConfig{LeaseTTL: -1}))
+	assert.Error(t, ValidateLease(&IPMConfig{LeaseTTL: 30, LeaseMode: "drop"}))
+	assert.NoError(t, ValidateLease(&IPMConfig{IPType: "node", LeaseTTL: 30, DeregisterExpiredNodes: true}))
+	assert.Error(t, ValidateLease(&IPMConfig{IPType: "node", DeregisterExpiredNodes: true}))
+	assert.Error(t, ValidateLease(&IPMConfig{IPType: "cluster", LeaseTTL: 30, DeregisterExpiredNodes: true}))
+}
+
+func TestNodeLease(t *testing.T) {
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testNodeLease(t, kv)
+		})
+		kv.Close()
+	}
+}
+
+func testNodeLease(t *testing.T, kv store.KV) {
+	config := &IPMConfig{Network: "10.127.0.0/29", Name: "lease-test", LeaseTTL: 60}
+	err := kv.DeletePrefix(config.KeyPrefix())
+	assert.NoError(t, err)
+
+	id, err := NodeLease(kv, &IPMConfig{}, "host1")
+	assert.NoError(t, err)
+	assert.Equal(t, store.NoLease, id)
+
+	id, err = NodeLease(kv, config, "host1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, store.NoLease, id)
+	renewed, err := NodeLease(kv, config, "host1")
+	assert.NoError(t, err)
+	assert.Equal(t, id, renewed)
+
+	_, subnet, _ := net.ParseCIDR(config.Network)
+	owner := Allocation{ContainerID: "pod1", IfName: "eth0", Node: "host1"}
+
+	t.Run("reclaim", func(t *testing.T) {
+		allocator := NewAllocator(kv, subnet, config.KeyPrefix()+"cluster/").WithOptions(LeaseOpts(config, id)...)
+		_, err := allocator.Allocate(owner)
+		assert.NoError(t, err)
+
+		err = kv.Revoke(id)
+		assert.NoError(t, err)
+
+		used, err := GetKeyValuesWithPrefix(kv, config.KeyPrefix()+"cluster/used/")
+		assert.NoError(t, err)
+		assert.Empty(t, used)
+
+		expired, err := ExpiredKeys(kv, config)
+		assert.NoError(t, err)
+		assert.Empty(t, expired)
+	})
+	t.Run("report", func(t *testing.T) {
+		report := *config
+		report.LeaseMode = LeaseModeReport
+		id, err := NodeLease(kv, &report, "host1")
+		assert.NoError(t, err)
+
+		allocator := NewAllocator(kv, subnet, report.KeyPrefix()+"cluster/").WithOptions(LeaseOpts(&report, id)...)
+		ipnet, err := allocator.Allocate(owner)
+		assert.NoError(t, err)
+
+		expired, err := ExpiredKeys(kv, &report)
+		assert.NoError(t, err)
+		assert.Empty(t, expired)
+
+		err = kv.Revoke(id)
+		assert.NoError(t, err)
+
+		expired, err = ExpiredKeys(kv, &report)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{report.KeyPrefix() + "cluster/used/" + ipnet.IP.String(): "host1"}, expired)
+	})
+}
+
+func TestDeregisterExpiredNodes(t *testing.T) {
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testDeregisterExpiredNodes(t, kv)
+		})
+		kv.Close()
+	}
+}
+
+func testDeregisterExpiredNodes(t *testing.T, kv store.KV) {
+	config := &IPMConfig{
+		IPType:                 "node",
+		Network:                "10.127.0.0/16",
+		SubnetLen:              24,
+		SubnetMin:              "10.127.1.0",
+		SubnetMax:              "10.127.9.0",
+		Name:                   "deregister-test",
+		LeaseTTL:               60,
+		LeaseMode:              LeaseModeReport,
+		DeregisterExpiredNodes: true,
+	}
+	err := kv.DeletePrefix(config.KeyPrefix())
+	assert.NoError(t, err)
+
+	//host1 is alive, host2 is gone and empty, host3 is gone with an IP left
+	for i, host := range []string{"host1", "host2", "host3"} {
+		cidr := fmt.Sprintf("10.127.%d.0/24", i+1)
+		ok, err := PutValuesIfAbsent(kv, map[string]string{
+			nodePrefix(config) + host:   cidr,
+			subnetPrefix(config) + cidr: host,
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	_, err = NodeLease(kv, config, "host1")
+	assert.NoError(t, err)
+	_, subnet, _ := net.ParseCIDR("10.127.3.0/24")
+	_, err = NewAllocator(kv, subnet, nodePrefix(config)+"host3/").Allocate(Allocation{ContainerID: "pod1", IfName: "eth0", Node: "host3"})
+	assert.NoError(t, err)
+
+	nodes, err := DeregisterExpiredNodes(kv, config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"host2"}, nodes)
+
+	subnets, err := NodeSubnets(kv, config)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"host1": "10.127.1.0/24", "host3": "10.127.3.0/24"}, subnets)
+}
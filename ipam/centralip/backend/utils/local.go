@@ -0,0 +1,55 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store/file"
+)
+
+const defaultLocalStorePath = "/var/lib/cni/centralip/local.json"
+
+// ValidateLocal checks that localIPs is only used where etcd never needs
+// to know the IPs of a node
+func ValidateLocal(config *IPMConfig) error {
+	if !config.LocalIPs {
+		return nil
+	}
+	if config.IPType != "node" {
+		return fmt.Errorf("localIPs requires the node mode")
+	}
+	if config.Store == "file" {
+		return fmt.Errorf("localIPs requires the etcd store")
+	}
+	//etcd doesn't see the IPs, so it can't tell when a subnet is unused
+	if config.LeaseTTL > 0 && config.LeaseMode != LeaseModeReport {
+		return fmt.Errorf("localIPs requires the report leaseMode")
+	}
+	if config.DeregisterExpiredNodes {
+		return fmt.Errorf("localIPs can't be used with deregisterExpiredNodes")
+	}
+	return nil
+}
+
+// ConnectLocal opens the file store keeping the IPs of the node in the
+// localIPs mode
+func ConnectLocal(config *IPMConfig) (store.KV, error) {
+	path := config.LocalStorePath
+	if path == "" {
+		path = defaultLocalStorePath
+	}
+	return file.New(path)
+}
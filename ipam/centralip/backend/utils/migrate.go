@@ -0,0 +1,112 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"strings"
+)
+
+// maxTxnKeys keeps each transaction of MoveKeys below the default limit of
+// 128 operations per etcd transaction
+const maxTxnKeys = 50
+
+// MigrateOnce runs migrate the first time a named network is used, to move
+// its state out of the unscoped keys shared by all networks.
+func MigrateOnce(kv store.KV, config *IPMConfig, migrate func() error) error {
+	if config.Name == "" {
+		return nil
+	}
+
+	marker := config.KeyPrefix() + "migrated"
+	_, done, err := GetValue(kv, marker)
+	if err != nil {
+		return err
+	}
+	if done {
+		return nil
+	}
+
+	if err := migrate(); err != nil {
+		//A concurrent first ADD may have finished the migration
+		if _, done, getErr := GetValue(kv, marker); getErr == nil && done {
+			return nil
+		}
+		return fmt.Errorf("Failed to migrate the unscoped keys of %s: %v", config.Name, err)
+	}
+	return PutValue(kv, marker, "true")
+}
+
+// MoveKeys moves keys from one prefix to another. keyValues holds the keys
+// with the values the caller read; a key modified since then makes the
+// move fail rather than overwrite the newer value. Keys a concurrent move
+// already took to the same place count as moved.
+func MoveKeys(kv store.KV, keyValues map[string]string, from, to string) error {
+	pending := make(map[string]string)
+
+	commit := func() error {
+		for len(pending) > 0 {
+			var cmps []store.Cmp
+			var ops []store.Op
+			for k, v := range pending {
+				cmps = append(cmps, store.ValueEquals(k, v))
+				ops = append(ops, store.OpPut(to+strings.TrimPrefix(k, from), v), store.OpDelete(k))
+			}
+			succeeded, err := kv.Txn(cmps, ops, nil)
+			if err != nil {
+				return err
+			}
+			if succeeded {
+				break
+			}
+
+			//Drop the keys moved meanwhile and try again with the others
+			for k, v := range pending {
+				current, ok, err := GetValue(kv, k)
+				if err != nil {
+					return err
+				}
+				if ok && current == v {
+					continue
+				}
+				moved, ok, err := GetValue(kv, to+strings.TrimPrefix(k, from))
+				if err != nil {
+					return err
+				}
+				if !ok || moved != v {
+					return fmt.Errorf("Keys under %s were modified during the move", from)
+				}
+				delete(pending, k)
+			}
+		}
+		pending = make(map[string]string)
+		return nil
+	}
+
+	for k, v := range keyValues {
+		if !strings.HasPrefix(k, from) {
+			return fmt.Errorf("Key %s is not under %s", k, from)
+		}
+		pending[k] = v
+
+		if len(pending) == maxTxnKeys {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+	}
+	return commit()
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMoveKeys(t *testing.T) {
+	from := ETCDPrefix + "move-test/from/"
+	to := ETCDPrefix + "move-test/to/"
+	keyValues := map[string]string{from + "a": "1", from + "b": "2", from + "c": "3"}
+
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, kv.DeletePrefix(ETCDPrefix+"move-test/"))
+			for k, v := range keyValues {
+				assert.NoError(t, PutValue(kv, k, v))
+			}
+
+			//A concurrent move already took a key, then all of them
+			assert.NoError(t, MoveKeys(kv, map[string]string{from + "a": "1"}, from, to))
+			assert.NoError(t, MoveKeys(kv, keyValues, from, to))
+			assert.NoError(t, MoveKeys(kv, keyValues, from, to))
+			moved, err := GetKeyValuesWithPrefix(kv, to)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{to + "a": "1", to + "b": "2", to + "c": "3"}, moved)
+
+			//A key changed since it was read still fails the move
+			assert.NoError(t, PutValue(kv, from+"d", "4"))
+			assert.NoError(t, PutValue(kv, from+"d", "5"))
+			assert.Error(t, MoveKeys(kv, map[string]string{from + "d": "4"}, from, to))
+		})
+		kv.Close()
+	}
+}
+
+func TestMigrateOnce(t *testing.T) {
+	config := &IPMConfig{Name: "migrate-test", Network: "10.123.0.0/16"}
+	runs := 0
+	migrate := func() error {
+		runs++
+		return nil
+	}
+
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			runs = 0
+			assert.NoError(t, kv.DeletePrefix(config.KeyPrefix()))
+
+			//A key that only starts with the marker doesn't count as one
+			assert.NoError(t, PutValue(kv, config.KeyPrefix()+"migrated-old", "true"))
+			assert.NoError(t, MigrateOnce(kv, config, migrate))
+			assert.NoError(t, MigrateOnce(kv, config, migrate))
+			assert.Equal(t, 1, runs)
+		})
+		kv.Close()
+	}
+}
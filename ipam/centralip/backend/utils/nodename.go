@@ -0,0 +1,293 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store/file"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// NodeNameEnv is the environment variable naming the node when the config
+// doesn't
+const NodeNameEnv = "CENTRALIP_NODE_NAME"
+
+const defaultNodeStatePath = "/var/lib/cni/centralip/node.json"
+
+// NodeName returns the name of the node: nodeName, $CENTRALIP_NODE_NAME,
+// the content of nodeNameFile, such as a file written from the downward
+// API of Kubernetes, or else the hostname
+func NodeName(config *IPMConfig) (string, error) {
+	name := config.NodeName
+	if name == "" {
+		name = os.Getenv(NodeNameEnv)
+	}
+	if name == "" && config.NodeNameFile != "" {
+		data, err := ioutil.ReadFile(config.NodeNameFile)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read the node name: %v", err)
+		}
+		name = strings.TrimSpace(string(data))
+		if name == "" {
+			return "", fmt.Errorf("The node name file %s is empty", config.NodeNameFile)
+		}
+	}
+	if name == "" {
+		var err error
+		name, err = os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("Failed to get the hostname: %v", err)
+		}
+	}
+
+	if name == "subnets" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("The node name %q is not allowed", name)
+	}
+	return name, nil
+}
+
+// TrackNodeName records name as the name of the node in the network, and
+// moves the subnet the node registered under its previous name to name.
+// Before anything is recorded, the previous name is the hostname older
+// versions registered with.
+func TrackNodeName(config *IPMConfig, name string) error {
+	state, err := file.New(nodeStatePath(config))
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	key := nodeNameKey(config)
+	previous, ok, err := GetValue(state, key)
+	if err != nil {
+		return err
+	}
+	if ok && previous == name {
+		return nil
+	}
+	if !ok {
+		previous, _ = os.Hostname()
+	}
+
+	if previous != "" && previous != name {
+		if err := renameNode(config, previous, name); err != nil {
+			return fmt.Errorf("Failed to move the subnet of %s to %s: %v", previous, name, err)
+		}
+	}
+	return PutValue(state, key, name)
+}
+
+func nodeStatePath(config *IPMConfig) string {
+	if config.NodeStatePath == "" {
+		return defaultNodeStatePath
+	}
+	return config.NodeStatePath
+}
+
+func nodeNameKey(config *IPMConfig) string {
+	return config.KeyPrefix() + "nodeName"
+}
+
+// RegisteredNodeName returns the name the subnet of the node is registered
+// under. Until an ADD moves the subnet of a renamed node, DEL and CHECK keep
+// using its previous name, so they find the IPs allocated before the rename
+// and don't register a subnet for the new name.
+func RegisteredNodeName(config *IPMConfig, name string) (string, error) {
+	previous := ""
+	if _, err := os.Stat(nodeStatePath(config)); err == nil {
+		state, err := file.New(nodeStatePath(config))
+		if err != nil {
+			return "", err
+		}
+		defer state.Close()
+		previous, _, err = GetValue(state, nodeNameKey(config))
+		if err != nil {
+			return "", err
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if previous == "" {
+		previous, _ = os.Hostname()
+	}
+	if previous == "" || previous == name {
+		return name, nil
+	}
+
+	kv, err := Connect(config)
+	if err != nil {
+		return "", err
+	}
+	defer kv.Close()
+	for _, host := range []string{name, previous} {
+		subnet, err := getKeyValue(kv, nodePrefix(config)+host)
+		if err != nil {
+			return "", err
+		}
+		if subnet != nil {
+			return host, nil
+		}
+	}
+	return name, nil
+}
+
+func renameNode(config *IPMConfig, from, to string) error {
+	kv, err := Connect(config)
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	if err := RenameNode(kv, config, from, to); err != nil {
+		return err
+	}
+	if !config.LocalIPs {
+		return nil
+	}
+
+	local, err := ConnectLocal(config)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	return RenameNode(local, config, from, to)
+}
+
+// getKeyValue returns the key with its revision and lease, or nil if it
+// doesn't exist
+func getKeyValue(kv store.KV, key string) (*store.KeyValue, error) {
+	kvs, _, err := kv.Range(key)
+	if err != nil {
+		return nil, err
+	}
+	for i := range kvs {
+		if kvs[i].Key == key {
+			return &kvs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// errNodeChanged fails a move of a node racing with another change of it
+var errNodeChanged = errors.New("node changed")
+
+// RenameNode moves the subnet, gateway and IPs of the node from to the node
+// to, along with the subnet index and the lease of the node. Nothing moves
+// if from holds no subnet or to already holds one. Concurrent ADDs of the
+// renamed node may all move it, and succeed once one of them did.
+func RenameNode(kv store.KV, config *IPMConfig, from, to string) error {
+	//Each failed move means another one went through, so the rename ends
+	for i := 0; i < 10; i++ {
+		err := moveNode(kv, config, from, to)
+		if err != errNodeChanged {
+			return err
+		}
+		subnet, err := getKeyValue(kv, nodePrefix(config)+to)
+		if err != nil || subnet != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("The node %s changed while moving it to %s", from, to)
+}
+
+func moveNode(kv store.KV, config *IPMConfig, from, to string) error {
+	prefix := nodePrefix(config)
+	subnet, err := getKeyValue(kv, prefix+from)
+	if err != nil || subnet == nil {
+		return err
+	}
+	taken, err := getKeyValue(kv, prefix+to)
+	if err != nil || taken != nil {
+		return err
+	}
+
+	//The heartbeat may already run under the new name, with its own lease
+	lease, err := getKeyValue(kv, leasePrefix(config)+from)
+	if err != nil {
+		return err
+	}
+	newLease, err := getKeyValue(kv, leasePrefix(config)+to)
+	if err != nil {
+		return err
+	}
+	leaseOf := func(keyValue *store.KeyValue) store.OpOption {
+		if lease != nil && newLease != nil && keyValue.Lease == lease.Lease {
+			return store.WithLease(newLease.Lease)
+		}
+		return store.WithLease(keyValue.Lease)
+	}
+
+	//The IPs move first, in as many transactions as needed, so a failed
+	//rename is resumed by the next ADD until the subnet itself moves
+	children, _, err := kv.Range(prefix + from + "/")
+	if err != nil {
+		return err
+	}
+	var cmps []store.Cmp
+	var ops []store.Op
+	commit := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		ok, err := kv.Txn(cmps, ops, nil)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errNodeChanged
+		}
+		cmps, ops = nil, nil
+		return nil
+	}
+	for i := range children {
+		child := &children[i]
+		value := child.Value
+		if owner := ParseAllocation(value); strings.Contains(child.Key, "/used/") && owner.Node == from {
+			owner.Node = to
+			value = owner.String()
+		}
+		cmps = append(cmps, store.ModRevisionEquals(child.Key, child.ModRevision))
+		ops = append(ops,
+			store.OpPut(prefix+to+strings.TrimPrefix(child.Key, prefix+from), value, leaseOf(child)),
+			store.OpDelete(child.Key))
+		if len(cmps) == maxTxnKeys {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+
+	cmps = []store.Cmp{store.ModRevisionEquals(subnet.Key, subnet.ModRevision), store.Absent(prefix + to)}
+	ops = []store.Op{store.OpPut(prefix+to, subnet.Value, leaseOf(subnet)), store.OpDelete(subnet.Key)}
+	index, err := getKeyValue(kv, subnetPrefix(config)+subnet.Value)
+	if err != nil {
+		return err
+	}
+	if index != nil && index.Value == from {
+		cmps = append(cmps, store.ModRevisionEquals(index.Key, index.ModRevision))
+		ops = append(ops, store.OpPut(index.Key, to, leaseOf(index)))
+	}
+	if lease != nil && newLease == nil {
+		cmps = append(cmps, store.ModRevisionEquals(lease.Key, lease.ModRevision), store.Absent(leasePrefix(config)+to))
+		ops = append(ops, store.OpPut(leasePrefix(config)+to, lease.Value, store.WithLease(lease.Lease)), store.OpDelete(lease.Key))
+	}
+	return commit()
+}
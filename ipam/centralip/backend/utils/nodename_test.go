@@ -0,0 +1,176 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestNodeName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centralip")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "nodename")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("node-file\n"), 0644))
+	defer os.Unsetenv(NodeNameEnv)
+
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+	name, err := NodeName(&IPMConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, hostname, name)
+
+	name, err = NodeName(&IPMConfig{NodeNameFile: file})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-file", name)
+
+	os.Setenv(NodeNameEnv, "node-env")
+	name, err = NodeName(&IPMConfig{NodeNameFile: file})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-env", name)
+
+	name, err = NodeName(&IPMConfig{NodeName: "node-config", NodeNameFile: file})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-config", name)
+
+	_, err = NodeName(&IPMConfig{NodeName: "subnets"})
+	assert.Error(t, err)
+	os.Unsetenv(NodeNameEnv)
+	_, err = NodeName(&IPMConfig{NodeNameFile: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
+
+func TestRenameNode(t *testing.T) {
+	config := &IPMConfig{
+		IPType:    "node",
+		Network:   "10.142.0.0/16",
+		SubnetLen: 24,
+		SubnetMin: "10.142.1.0",
+		SubnetMax: "10.142.9.0",
+		Name:      "rename-test",
+	}
+	p := nodePrefix(config)
+
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, kv.DeletePrefix(config.KeyPrefix()))
+			for k, v := range map[string]string{
+				"old":                    "10.142.1.0/24",
+				"subnets/10.142.1.0/24":  "old",
+				"old/gateway":            "10.142.1.1",
+				"old/lastReserved":       "10.142.1.2",
+				"old/used/10.142.1.2":    Allocation{ContainerID: "c1", IfName: "eth0", Node: "old"}.String(),
+				"old/containers/c1/eth0": "10.142.1.2",
+				"older":                  "10.142.2.0/24",
+				"subnets/10.142.2.0/24":  "older",
+			} {
+				assert.NoError(t, PutValue(kv, p+k, v))
+			}
+
+			assert.NoError(t, RenameNode(kv, config, "old", "new"))
+			subnets, err := NodeSubnets(kv, config)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{"new": "10.142.1.0/24", "older": "10.142.2.0/24"}, subnets)
+			problems, err := CheckSubnets(kv, config)
+			assert.NoError(t, err)
+			assert.Empty(t, problems)
+
+			used, ok, err := GetValue(kv, p+"new/used/10.142.1.2")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "new", ParseAllocation(used).Node)
+			gateway, _, err := GetValue(kv, p+"new/gateway")
+			assert.NoError(t, err)
+			assert.Equal(t, "10.142.1.1", gateway)
+			keyValues, err := GetKeyValuesWithPrefix(kv, p+"old/")
+			assert.NoError(t, err)
+			assert.Empty(t, keyValues)
+
+			//Concurrent ADDs of the renamed node all succeed
+			assert.NoError(t, PutValue(kv, p+"busy", "10.142.3.0/24"))
+			assert.NoError(t, PutValue(kv, p+"subnets/10.142.3.0/24", "busy"))
+			for i := 2; i < 200; i++ {
+				ip := fmt.Sprintf("10.142.3.%d", i)
+				assert.NoError(t, PutValue(kv, p+"busy/used/"+ip, Allocation{ContainerID: ip, IfName: "eth0", Node: "busy"}.String()))
+			}
+			var wg sync.WaitGroup
+			errs := make([]error, 4)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = RenameNode(kv, config, "busy", "renamed")
+				}(i)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				assert.NoError(t, err)
+			}
+			moved, err := GetKeyValuesWithPrefix(kv, p+"renamed/used/")
+			assert.NoError(t, err)
+			assert.Len(t, moved, 198)
+
+			//A node already holding a subnet keeps it
+			assert.NoError(t, RenameNode(kv, config, "older", "new"))
+			subnet, _, err := GetValue(kv, p+"older")
+			assert.NoError(t, err)
+			assert.Equal(t, "10.142.2.0/24", subnet)
+		})
+		kv.Close()
+	}
+}
+
+func TestTrackNodeName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centralip")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+
+	config := &IPMConfig{
+		IPType:        "node",
+		Network:       "10.143.0.0/16",
+		SubnetLen:     24,
+		SubnetMin:     "10.143.1.0",
+		SubnetMax:     "10.143.9.0",
+		Name:          "track-test",
+		Store:         "file",
+		StorePath:     filepath.Join(dir, "store.json"),
+		NodeStatePath: filepath.Join(dir, "node.json"),
+	}
+	kv, err := Connect(config)
+	assert.NoError(t, err)
+	defer kv.Close()
+	assert.NoError(t, PutValue(kv, nodePrefix(config)+hostname, "10.143.1.0/24"))
+	assert.NoError(t, PutValue(kv, subnetPrefix(config)+"10.143.1.0/24", hostname))
+
+	//Nothing recorded yet, so the subnet of the hostname moves
+	assert.NoError(t, TrackNodeName(config, "node1"))
+	subnets, err := NodeSubnets(kv, config)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"node1": "10.143.1.0/24"}, subnets)
+
+	assert.NoError(t, TrackNodeName(config, "node1"))
+	assert.NoError(t, TrackNodeName(config, "node2"))
+	subnets, err = NodeSubnets(kv, config)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"node2": "10.143.1.0/24"}, subnets)
+}
@@ -0,0 +1,347 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// UsedIP is an allocated address of the network with its owner
+type UsedIP struct {
+	IP    net.IP
+	Owner Allocation
+	// Key marks the IP as used, under the prefix of its allocator
+	Key   string
+	value string
+}
+
+// Usage tells how much of a subnet is allocated
+type Usage struct {
+	Subnet *net.IPNet
+	// Node owns the subnet in the node mode, and the namespace in the
+	// namespace mode
+	Node string
+	Used int
+	Size *big.Int
+}
+
+// nodePrefix holds the subnet of each node, or of each namespace in the
+// namespace mode, which registers its subnets the same way
+func nodePrefix(config *IPMConfig) string {
+	if config.IPType == "namespace" {
+		return config.KeyPrefix() + "namespace/names/"
+	}
+	return config.KeyPrefix() + "node/"
+}
+
+// subnetPrefix holds the index of the subnets. It lives beside the names
+// of the namespaces, which may be anything, but under the node names.
+func subnetPrefix(config *IPMConfig) string {
+	if config.IPType == "namespace" {
+		return config.KeyPrefix() + "namespace/subnets/"
+	}
+	return nodePrefix(config) + "subnets/"
+}
+
+// NodeSubnets returns the subnet registered for each node, as stored in
+// node/<hostname>, or for each namespace in the namespace mode
+func NodeSubnets(kv store.KV, config *IPMConfig) (map[string]string, error) {
+	keyValues, err := GetKeyValuesWithPrefix(kv, nodePrefix(config))
+	if err != nil {
+		return nil, err
+	}
+
+	subnets := make(map[string]string)
+	for k, v := range keyValues {
+		host := strings.TrimPrefix(k, nodePrefix(config))
+		if !strings.Contains(host, "/") {
+			subnets[host] = v
+		}
+	}
+	return subnets, nil
+}
+
+// UsedIPs returns the allocated addresses of the network sorted by IP
+func UsedIPs(kv store.KV, config *IPMConfig) ([]UsedIP, error) {
+	keyValues, err := GetKeyValuesWithPrefix(kv, config.KeyPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []UsedIP
+	for k, v := range keyValues {
+		rest := strings.TrimPrefix(k, config.KeyPrefix())
+		if !strings.HasPrefix(rest, "node/") && !strings.HasPrefix(rest, "cluster/") && !strings.HasPrefix(rest, "namespace/") {
+			continue
+		}
+		i := strings.Index(rest, "/used/")
+		if i < 0 {
+			continue
+		}
+		ip := net.ParseIP(rest[i+len("/used/"):])
+		if ip == nil {
+			continue
+		}
+
+		owner := ParseAllocation(v)
+		//Allocations made before the owner recorded its node live under
+		//node/<hostname>/used/ in the node mode
+		if owner.Node == "" && strings.HasPrefix(rest, "node/") {
+			owner.Node = rest[len("node/"):i]
+		}
+		ips = append(ips, UsedIP{IP: ip, Owner: owner, Key: k, value: v})
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		return IPToBigInt(ips[i].IP).Cmp(IPToBigInt(ips[j].IP)) < 0
+	})
+	return ips, nil
+}
+
+// ReleaseIP frees ip whoever owns it, along with the index of its
+// container, as DEL would have done
+func ReleaseIP(kv store.KV, config *IPMConfig, ip net.IP) error {
+	ips, err := UsedIPs(kv, config)
+	if err != nil {
+		return err
+	}
+
+	for _, used := range ips {
+		if !used.IP.Equal(ip) {
+			continue
+		}
+
+		return ReleaseUsedIP(kv, used)
+	}
+	return fmt.Errorf("%s is not allocated in %s", ip, config.Network)
+}
+
+// ReleaseUsedIP frees the IP of used and the index of its container,
+// unless the IP changed hands since it was listed
+func ReleaseUsedIP(kv store.KV, used UsedIP) error {
+	cmps := []store.Cmp{store.ValueEquals(used.Key, used.value)}
+	ops := []store.Op{store.OpDelete(used.Key)}
+
+	//The index is only removed if it still points to the IP
+	prefix := strings.TrimSuffix(used.Key, "used/"+used.IP.String())
+	containerKey := prefix + "containers/" + used.Owner.ContainerID + "/" + used.Owner.IfName
+	indexed, ok, err := GetValue(kv, containerKey)
+	if err != nil {
+		return err
+	}
+	if ok && net.ParseIP(indexed).Equal(used.IP) {
+		cmps = append(cmps, store.ValueEquals(containerKey, indexed))
+		ops = append(ops, store.OpDelete(containerKey))
+	}
+
+	//So is the sticky IP of the pod
+	if used.Owner.Pod != "" {
+		podKey := prefix + "pods/" + used.Owner.Pod
+		sticky, ok, err := GetValue(kv, podKey)
+		if err != nil {
+			return err
+		}
+		if ok && net.ParseIP(sticky).Equal(used.IP) {
+			cmps = append(cmps, store.ValueEquals(podKey, sticky))
+			ops = append(ops, store.OpDelete(podKey))
+		}
+	}
+
+	succeeded, err := kv.Txn(cmps, ops, nil)
+	if err != nil {
+		return err
+	}
+	if !succeeded {
+		return fmt.Errorf("%s was modified while releasing it", used.IP)
+	}
+	return nil
+}
+
+// ReleaseSubnet frees the subnet of a node, with every address allocated
+// in it. name is either the node or its subnet.
+func ReleaseSubnet(kv store.KV, config *IPMConfig, name string) error {
+	return releaseSubnet(kv, config, name)
+}
+
+// releaseSubnet frees the subnet of name, with its keys, if cmps hold
+func releaseSubnet(kv store.KV, config *IPMConfig, name string, cmps ...store.Cmp) error {
+	host := name
+	if _, subnet, err := net.ParseCIDR(name); err == nil {
+		owner, ok, err := GetValue(kv, subnetPrefix(config)+subnet.String())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("The subnet %s is not registered", subnet)
+		}
+		host = owner
+	}
+
+	subnet, ok, err := GetValue(kv, nodePrefix(config)+host)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("The node %s has no subnet", host)
+	}
+
+	//The node may come back with a new ADD meanwhile, so only drop the keys
+	//describing the subnet we read
+	cmps = append(cmps, store.ValueEquals(nodePrefix(config)+host, subnet))
+	ops := []store.Op{store.OpDelete(nodePrefix(config) + host), store.OpDeletePrefix(nodePrefix(config) + host + "/")}
+	owner, ok, err := GetValue(kv, subnetPrefix(config)+subnet)
+	if err != nil {
+		return err
+	}
+	if ok && owner == host {
+		cmps = append(cmps, store.ValueEquals(subnetPrefix(config)+subnet, host))
+		ops = append(ops, store.OpDelete(subnetPrefix(config)+subnet))
+	}
+
+	succeeded, err := kv.Txn(cmps, ops, nil)
+	if err != nil {
+		return err
+	}
+	if !succeeded {
+		return fmt.Errorf("The subnet of %s was modified while releasing it", host)
+	}
+	return nil
+}
+
+// DeregisterNode frees the subnet of a node that left the cluster, or of
+// a deleted namespace in the namespace mode. It refuses while IPs are
+// still allocated in the subnet, which should be drained first, or
+// released with ReleaseSubnet. With localIPs only the node knows its IPs,
+// so it always refuses.
+func DeregisterNode(kv store.KV, config *IPMConfig, host string) error {
+	if config.LocalIPs {
+		return fmt.Errorf("The IPs of %s are only kept on the node with localIPs, so it can't be deregistered", host)
+	}
+	usedPrefix := nodePrefix(config) + host + "/used/"
+	used, revision, err := kv.Range(usedPrefix)
+	if err != nil {
+		return err
+	}
+	if len(used) > 0 {
+		return fmt.Errorf("%s still has %d allocated IPs", host, len(used))
+	}
+	//An ADD claiming an IP meanwhile keeps the subnet
+	return releaseSubnet(kv, config, host, store.PrefixUnchangedSince(usedPrefix, revision))
+}
+
+// PoolUsage returns the usage of the network in the cluster mode, and of
+// the subnet of each node or namespace in the node and namespace modes
+func PoolUsage(kv store.KV, config *IPMConfig) ([]Usage, error) {
+	exclude, err := config.ValidateRange()
+	if err != nil {
+		return nil, err
+	}
+	ips, err := UsedIPs(kv, config)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := func(subnet *net.IPNet, node string, gateway net.IP) Usage {
+		u := Usage{Subnet: subnet, Node: node}
+		u.Size = NewAllocator(kv, subnet, "", gateway).
+			WithRange(net.ParseIP(config.RangeStart), net.ParseIP(config.RangeEnd)).
+			WithExclude(exclude...).
+			Size()
+		for _, ip := range ips {
+			if subnet.Contains(ip.IP) && (config.IPType != "node" || ip.Owner.Node == node) {
+				u.Used++
+			}
+		}
+		return u
+	}
+
+	if config.IPType != "node" && config.IPType != "namespace" {
+		_, network, err := net.ParseCIDR(config.Network)
+		if err != nil {
+			return nil, err
+		}
+		gateway := GetNextIP(network)
+		if config.Gateway != "" {
+			gateway = net.ParseIP(config.Gateway)
+		}
+		return []Usage{usage(network, "", gateway)}, nil
+	}
+
+	subnets, err := NodeSubnets(kv, config)
+	if err != nil {
+		return nil, err
+	}
+	var usages []Usage
+	for host, cidr := range subnets {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid subnet %q of node %s", cidr, host)
+		}
+		gateway := GetNextIP(subnet)
+		if gw := net.ParseIP(config.Gateway); gw != nil && subnet.Contains(gw) {
+			gateway = gw
+		}
+		usages = append(usages, usage(subnet, host, gateway))
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return IPToBigInt(usages[i].Subnet.IP).Cmp(IPToBigInt(usages[j].Subnet.IP)) < 0
+	})
+	return usages, nil
+}
+
+// CheckSubnets returns the inconsistencies between node/<hostname> and
+// node/subnets/<cidr>, which should always point at each other
+func CheckSubnets(kv store.KV, config *IPMConfig) ([]string, error) {
+	keyValues, err := GetKeyValuesWithPrefix(kv, subnetPrefix(config))
+	if err != nil {
+		return nil, err
+	}
+	subnets := make(map[string]string)
+	for k, v := range keyValues {
+		subnets[strings.TrimPrefix(k, subnetPrefix(config))] = v
+	}
+
+	nodes, err := NodeSubnets(kv, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for host, subnet := range nodes {
+		owner, ok := subnets[subnet]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("node %s holds %s, which is not registered in subnets", host, subnet))
+		case owner != host:
+			problems = append(problems, fmt.Sprintf("node %s holds %s, which is registered to %s", host, subnet, owner))
+		}
+	}
+	for subnet, host := range subnets {
+		held, ok := nodes[host]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("subnet %s is registered to %s, which holds no subnet", subnet, host))
+		case held != subnet:
+			problems = append(problems, fmt.Sprintf("subnet %s is registered to %s, which holds %s", subnet, host, held))
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
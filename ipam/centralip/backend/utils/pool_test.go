@@ -0,0 +1,161 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testPool(t, kv)
+		})
+		kv.Close()
+	}
+}
+
+func testPool(t *testing.T, kv store.KV) {
+	config := &IPMConfig{
+		IPType:    "node",
+		Network:   "10.128.0.0/16",
+		SubnetLen: 24,
+		SubnetMin: "10.128.1.0",
+		SubnetMax: "10.128.4.0",
+		Name:      "pool-test",
+	}
+	err := kv.DeletePrefix(config.KeyPrefix())
+	assert.NoError(t, err)
+
+	nodes := map[string]string{"host1": "10.128.1.0/24", "host2": "10.128.2.0/24"}
+	for host, cidr := range nodes {
+		ok, err := PutValuesIfAbsent(kv, map[string]string{
+			nodePrefix(config) + host:   cidr,
+			subnetPrefix(config) + cidr: host,
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		_, subnet, _ := net.ParseCIDR(cidr)
+		allocator := NewAllocator(kv, subnet, nodePrefix(config)+host+"/", GetNextIP(subnet))
+		for _, pod := range []string{"pod1", "pod2"} {
+			_, err := allocator.Allocate(Allocation{ContainerID: pod, IfName: "eth0", Node: host})
+			assert.NoError(t, err)
+		}
+	}
+
+	subnets, err := NodeSubnets(kv, config)
+	assert.NoError(t, err)
+	assert.Equal(t, nodes, subnets)
+
+	ips, err := UsedIPs(kv, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(ips))
+	assert.Equal(t, "10.128.1.2", ips[0].IP.String())
+	assert.Equal(t, Allocation{ContainerID: "pod1", IfName: "eth0", Node: "host1"}, ips[0].Owner)
+
+	usages, err := PoolUsage(kv, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(usages))
+	assert.Equal(t, "host1", usages[0].Node)
+	assert.Equal(t, 2, usages[0].Used)
+	assert.Equal(t, "253", usages[0].Size.String())
+
+	count, err := SubnetCount(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "4", count.String())
+
+	t.Run("release ip", func(t *testing.T) {
+		err := ReleaseIP(kv, config, net.ParseIP("10.128.1.2"))
+		assert.NoError(t, err)
+		_, ok, err := GetValue(kv, nodePrefix(config)+"host1/containers/pod1/eth0")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		err = ReleaseIP(kv, config, net.ParseIP("10.128.1.2"))
+		assert.Error(t, err)
+	})
+
+	t.Run("check", func(t *testing.T) {
+		problems, err := CheckSubnets(kv, config)
+		assert.NoError(t, err)
+		assert.Empty(t, problems)
+
+		err = PutValue(kv, subnetPrefix(config)+"10.128.3.0/24", "host1")
+		assert.NoError(t, err)
+		problems, err = CheckSubnets(kv, config)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"subnet 10.128.3.0/24 is registered to host1, which holds 10.128.1.0/24"}, problems)
+		err = DeleteKey(kv, subnetPrefix(config)+"10.128.3.0/24")
+		assert.NoError(t, err)
+	})
+
+	t.Run("release subnet", func(t *testing.T) {
+		err := ReleaseSubnet(kv, config, "10.128.2.0/24")
+		assert.NoError(t, err)
+
+		subnets, err := NodeSubnets(kv, config)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"host1": "10.128.1.0/24"}, subnets)
+		ips, err := UsedIPs(kv, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(ips))
+		problems, err := CheckSubnets(kv, config)
+		assert.NoError(t, err)
+		assert.Empty(t, problems)
+
+		err = ReleaseSubnet(kv, config, "host2")
+		assert.Error(t, err)
+	})
+
+	t.Run("deregister", func(t *testing.T) {
+		err := DeregisterNode(kv, config, "host1")
+		assert.Error(t, err)
+
+		err = ReleaseIP(kv, config, net.ParseIP("10.128.1.3"))
+		assert.NoError(t, err)
+
+		//An ADD claiming an IP after the count keeps the subnet
+		usedPrefix := nodePrefix(config) + "host1/used/"
+		_, revision, err := kv.Range(usedPrefix)
+		assert.NoError(t, err)
+		assert.NoError(t, PutValue(kv, usedPrefix+"10.128.1.9", Allocation{ContainerID: "pod9", IfName: "eth0", Node: "host1"}.String()))
+		err = releaseSubnet(kv, config, "host1", store.PrefixUnchangedSince(usedPrefix, revision))
+		assert.Error(t, err)
+		_, ok, err := GetValue(kv, nodePrefix(config)+"host1")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.NoError(t, ReleaseIP(kv, config, net.ParseIP("10.128.1.9")))
+
+		//With localIPs etcd can't tell the node is empty
+		local := *config
+		local.LocalIPs = true
+		err = DeregisterNode(kv, &local, "host1")
+		assert.Error(t, err)
+
+		err = DeregisterNode(kv, config, "host1")
+		assert.NoError(t, err)
+		keyValues, err := GetKeyValuesWithPrefix(kv, nodePrefix(config)+"host1/")
+		assert.NoError(t, err)
+		assert.Empty(t, keyValues)
+
+		subnets, err := NodeSubnets(kv, config)
+		assert.NoError(t, err)
+		assert.Empty(t, subnets)
+	})
+}
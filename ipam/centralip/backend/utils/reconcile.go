@@ -0,0 +1,156 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"net"
+	"strings"
+)
+
+// Live is what still runs: an allocation is alive when its container or its
+// IP is listed. Sources knowing only one of them leave the other empty.
+type Live struct {
+	ContainerIDs map[string]bool
+	IPs          map[string]bool
+}
+
+// NewLive returns an empty Live
+func NewLive() *Live {
+	return &Live{ContainerIDs: make(map[string]bool), IPs: make(map[string]bool)}
+}
+
+func (l *Live) holds(used UsedIP) bool {
+	return l.ContainerIDs[used.Owner.ContainerID] || l.IPs[used.IP.String()]
+}
+
+// ReconcileOptions tells Reconcile which allocations to look at and what to
+// do with the orphans
+type ReconcileOptions struct {
+	// Node limits the run to the allocations of a node, since most sources
+	// only know the containers of their own node. Empty means all nodes.
+	Node string
+	// DryRun only reports the orphans
+	DryRun bool
+	// MaxRelease is the percentage of the allocated IPs a run may release
+	MaxRelease int
+}
+
+// ReconcileResult lists what Reconcile found and did
+type ReconcileResult struct {
+	// Orphans are the allocations owned by no live container
+	Orphans []UsedIP
+	// Marked are the orphans seen for the first time, released by the next
+	// run if they are still orphans then
+	Marked []UsedIP
+	// Released are the orphans already marked by the previous run
+	Released []UsedIP
+}
+
+func orphanPrefix(config *IPMConfig) string {
+	return config.KeyPrefix() + "orphans/"
+}
+
+// Reconcile frees the IPs whose container is gone without running DEL.
+// An orphan is first marked in orphans/<ip> and only released by the next
+// run, so an ADD still in progress, whose container the source doesn't list
+// yet, isn't freed under its feet.
+func Reconcile(kv store.KV, config *IPMConfig, live *Live, opts ReconcileOptions) (*ReconcileResult, error) {
+	ips, err := UsedIPs(kv, config)
+	if err != nil {
+		return nil, err
+	}
+	keyValues, err := GetKeyValuesWithPrefix(kv, orphanPrefix(config))
+	if err != nil {
+		return nil, err
+	}
+	marks := make(map[string]string)
+	for k, v := range keyValues {
+		marks[strings.TrimPrefix(k, orphanPrefix(config))] = v
+	}
+
+	result := &ReconcileResult{}
+	allocated := 0
+	orphans := make(map[string]bool)
+	for _, used := range ips {
+		if opts.Node != "" && used.Owner.Node != opts.Node {
+			continue
+		}
+		allocated++
+		//A held sticky IP has no container until its pod comes back, and
+		//expires with its lease
+		if live.holds(used) || used.Owner.Held {
+			continue
+		}
+
+		ip := used.IP.String()
+		orphans[ip] = true
+		result.Orphans = append(result.Orphans, used)
+		//A mark only stands for the owner it was made for
+		if marks[ip] == used.value {
+			result.Released = append(result.Released, used)
+		} else {
+			result.Marked = append(result.Marked, used)
+		}
+	}
+
+	if len(result.Released)*100 > allocated*opts.MaxRelease {
+		return result, fmt.Errorf("refusing to release %d of the %d allocated IPs of %s, more than %d%%",
+			len(result.Released), allocated, config.Network, opts.MaxRelease)
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	for _, used := range result.Released {
+		if err := ReleaseUsedIP(kv, used); err != nil {
+			return result, err
+		}
+		if err := kv.Delete(orphanPrefix(config) + used.IP.String()); err != nil {
+			return result, err
+		}
+	}
+	for _, used := range result.Marked {
+		if err := kv.Put(orphanPrefix(config)+used.IP.String(), used.value); err != nil {
+			return result, err
+		}
+	}
+
+	//Drop the marks of the IPs that came back to life or were freed by DEL,
+	//as long as they are in the scope of the run
+	for ip := range marks {
+		if orphans[ip] || !inScope(ips, ip, opts.Node) {
+			continue
+		}
+		if err := kv.Delete(orphanPrefix(config) + ip); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func inScope(ips []UsedIP, ip, node string) bool {
+	if node == "" {
+		return true
+	}
+	for _, used := range ips {
+		if used.IP.Equal(net.ParseIP(ip)) {
+			return used.Owner.Node == node
+		}
+	}
+	//The IP is free, so its mark is stale whoever made it
+	return true
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	for name, kv := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testReconcile(t, kv)
+		})
+		kv.Close()
+	}
+}
+
+func testReconcile(t *testing.T, kv store.KV) {
+	config := &IPMConfig{
+		IPType:  "cluster",
+		Network: "10.129.0.0/16",
+		Name:    "reconcile-test",
+	}
+	err := kv.DeletePrefix(config.KeyPrefix())
+	assert.NoError(t, err)
+
+	_, network, _ := net.ParseCIDR(config.Network)
+	allocator := NewAllocator(kv, network, config.KeyPrefix()+"cluster/", GetNextIP(network))
+	for i := 0; i < 10; i++ {
+		node := "host1"
+		if i%2 == 1 {
+			node = "host2"
+		}
+		_, err := allocator.Allocate(Allocation{ContainerID: fmt.Sprintf("pod%d", i), IfName: "eth0", Node: node})
+		assert.NoError(t, err)
+	}
+
+	live := NewLive()
+	for i := 0; i < 10; i++ {
+		live.ContainerIDs[fmt.Sprintf("pod%d", i)] = true
+	}
+	//pod0 and pod2 of host1 are gone, pod4 is only known by its IP
+	delete(live.ContainerIDs, "pod0")
+	delete(live.ContainerIDs, "pod2")
+	delete(live.ContainerIDs, "pod4")
+	live.IPs["10.129.0.6"] = true
+
+	countUsed := func() int {
+		ips, err := UsedIPs(kv, config)
+		assert.NoError(t, err)
+		return len(ips)
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		result, err := Reconcile(kv, config, live, ReconcileOptions{Node: "host1", DryRun: true, MaxRelease: 100})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(result.Orphans))
+		assert.Equal(t, "10.129.0.2", result.Orphans[0].IP.String())
+		assert.Equal(t, "10.129.0.4", result.Orphans[1].IP.String())
+		assert.Equal(t, 2, len(result.Marked))
+		assert.Equal(t, 0, len(result.Released))
+
+		marks, err := GetKeyValuesWithPrefix(kv, orphanPrefix(config))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(marks))
+	})
+
+	t.Run("mark then release", func(t *testing.T) {
+		result, err := Reconcile(kv, config, live, ReconcileOptions{Node: "host1", MaxRelease: 100})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(result.Marked))
+		assert.Equal(t, 0, len(result.Released))
+		assert.Equal(t, 10, countUsed())
+
+		//pod2 shows up, as its ADD was still running
+		live.ContainerIDs["pod2"] = true
+		result, err = Reconcile(kv, config, live, ReconcileOptions{Node: "host1", MaxRelease: 100})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(result.Released))
+		assert.Equal(t, Allocation{ContainerID: "pod0", IfName: "eth0", Node: "host1"}, result.Released[0].Owner)
+		assert.Equal(t, 9, countUsed())
+
+		marks, err := GetKeyValuesWithPrefix(kv, orphanPrefix(config))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(marks))
+	})
+
+	t.Run("threshold", func(t *testing.T) {
+		//A source listing nothing would release the whole node
+		empty := NewLive()
+		result, err := Reconcile(kv, config, empty, ReconcileOptions{Node: "host1", MaxRelease: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, 4, len(result.Marked))
+
+		result, err = Reconcile(kv, config, empty, ReconcileOptions{Node: "host1", MaxRelease: 10})
+		assert.Error(t, err)
+		assert.Equal(t, 4, len(result.Released))
+		assert.Equal(t, 9, countUsed())
+	})
+
+	t.Run("the other node is untouched", func(t *testing.T) {
+		result, err := Reconcile(kv, config, NewLive(), ReconcileOptions{Node: "host2", DryRun: true, MaxRelease: 100})
+		assert.NoError(t, err)
+		assert.Equal(t, 5, len(result.Orphans))
+		for _, used := range result.Orphans {
+			assert.Equal(t, "host2", used.Owner.Node)
+		}
+	})
+}
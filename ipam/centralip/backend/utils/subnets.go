@@ -0,0 +1,199 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// SubnetRange is a parent range the node subnets are carved from. Both
+// ends are the first IP of a subnet of subnetLen, and the range includes
+// the subnet starting at SubnetMax.
+type SubnetRange struct {
+	SubnetMin string `json:"subnetMin"`
+	SubnetMax string `json:"subnetMax"`
+}
+
+// subnetRange is a SubnetRange with its ends parsed
+type subnetRange struct {
+	min, max *big.Int
+}
+
+// allSubnetRanges returns subnetMin..subnetMax, if set, followed by the
+// subnetRanges of the config
+func (config *IPMConfig) allSubnetRanges() []SubnetRange {
+	var ranges []SubnetRange
+	if config.SubnetMin != "" || config.SubnetMax != "" {
+		ranges = append(ranges, SubnetRange{SubnetMin: config.SubnetMin, SubnetMax: config.SubnetMax})
+	}
+	return append(ranges, config.SubnetRanges...)
+}
+
+func (config *IPMConfig) subnetBits() int {
+	if config.IsIPv6() {
+		return 8 * net.IPv6len
+	}
+	return 8 * net.IPv4len
+}
+
+// validateSubnets parses the subnet ranges as ValidateSubnets checks them,
+// and returns them sorted by their first subnet
+func (config *IPMConfig) validateSubnets() ([]subnetRange, error) {
+	_, network, err := net.ParseCIDR(config.Network)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid network %q: %v", config.Network, err)
+	}
+	ones, bits := network.Mask.Size()
+	if config.SubnetLen < ones || config.SubnetLen > bits {
+		return nil, fmt.Errorf("The subnetLen %d should be between %d and %d for %s", config.SubnetLen, ones, bits, network)
+	}
+
+	mask := net.CIDRMask(config.SubnetLen, bits)
+	parse := func(value string) (*big.Int, error) {
+		ip := net.ParseIP(value)
+		if ip == nil || !network.Contains(ip) {
+			return nil, fmt.Errorf("The subnet %q is not in the network %s", value, network)
+		}
+		if !ip.Mask(mask).Equal(ip) {
+			return nil, fmt.Errorf("The subnet %q is not aligned to the subnetLen %d", value, config.SubnetLen)
+		}
+		return IPToBigInt(ip), nil
+	}
+
+	var ranges []subnetRange
+	for _, r := range config.allSubnetRanges() {
+		min, err := parse(r.SubnetMin)
+		if err != nil {
+			return nil, err
+		}
+		max, err := parse(r.SubnetMax)
+		if err != nil {
+			return nil, err
+		}
+		if min.Cmp(max) > 0 {
+			return nil, fmt.Errorf("The subnetMin %s is after the subnetMax %s", r.SubnetMin, r.SubnetMax)
+		}
+		ranges = append(ranges, subnetRange{min: min, max: max})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("The node mode needs subnetMin and subnetMax, or subnetRanges")
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].min.Cmp(ranges[j].min) < 0 })
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].min.Cmp(ranges[i-1].max) <= 0 {
+			return nil, fmt.Errorf("The subnet ranges of %s overlap", network)
+		}
+	}
+	return ranges, nil
+}
+
+// ValidateSubnets checks that subnetLen fits in the network, and that the
+// subnet ranges are aligned to subnetLen, inside the network and disjoint
+func (config *IPMConfig) ValidateSubnets() error {
+	_, err := config.validateSubnets()
+	return err
+}
+
+// InSubnetRanges reports whether subnet was carved out of the subnet
+// ranges, whatever its length
+func (config *IPMConfig) InSubnetRanges(subnet *net.IPNet) bool {
+	if (subnet.IP.To4() == nil) != config.IsIPv6() {
+		return false
+	}
+	ip := IPToBigInt(subnet.IP)
+	for _, r := range config.allSubnetRanges() {
+		min, max := net.ParseIP(r.SubnetMin), net.ParseIP(r.SubnetMax)
+		if min == nil || max == nil {
+			continue
+		}
+		if ip.Cmp(IPToBigInt(min)) >= 0 && ip.Cmp(IPToBigInt(max)) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lastIP returns the last address of subnet as an integer
+func lastIP(subnet *net.IPNet) *big.Int {
+	ones, bits := subnet.Mask.Size()
+	last := new(big.Int).Add(IPToBigInt(subnet.IP), HostCount(ones, bits))
+	return last.Sub(last, big.NewInt(1))
+}
+
+// NextSubnet returns the first subnet of subnetLen in the subnet ranges
+// that overlaps none of registered. The registered subnets may have other
+// lengths, since node pools can ask for subnets of different sizes.
+func NextSubnet(config *IPMConfig, registered []*net.IPNet) (*net.IPNet, error) {
+	ranges, err := config.validateSubnets()
+	if err != nil {
+		return nil, err
+	}
+
+	taken := append([]*net.IPNet{}, registered...)
+	sort.Slice(taken, func(i, j int) bool {
+		return IPToBigInt(taken[i].IP).Cmp(IPToBigInt(taken[j].IP)) < 0
+	})
+
+	bits := config.subnetBits()
+	mask := net.CIDRMask(config.SubnetLen, bits)
+	step := HostCount(config.SubnetLen, bits)
+	for _, r := range ranges {
+		cur := new(big.Int).Set(r.min)
+		for cur.Cmp(r.max) <= 0 {
+			subnet := &net.IPNet{IP: BigIntToIP(cur, bits == 8*net.IPv6len), Mask: mask}
+			first, last := cur, lastIP(subnet)
+
+			var overlap *net.IPNet
+			for _, t := range taken {
+				if IPToBigInt(t.IP).Cmp(last) <= 0 && lastIP(t).Cmp(first) >= 0 {
+					overlap = t
+					break
+				}
+			}
+			if overlap == nil {
+				return subnet, nil
+			}
+
+			//Skip to the first aligned subnet after the overlapping one
+			offset := new(big.Int).Sub(lastIP(overlap), r.min)
+			offset.Div(offset, step)
+			offset.Add(offset, big.NewInt(1))
+			cur = offset.Mul(offset, step).Add(offset, r.min)
+		}
+	}
+	return nil, fmt.Errorf("No available subnet for registering")
+}
+
+// SubnetCount returns the number of node subnets of subnetLen in the
+// subnet ranges
+func SubnetCount(config *IPMConfig) (*big.Int, error) {
+	ranges, err := config.validateSubnets()
+	if err != nil {
+		return nil, err
+	}
+
+	step := HostCount(config.SubnetLen, config.subnetBits())
+	count := big.NewInt(0)
+	for _, r := range ranges {
+		n := new(big.Int).Sub(r.max, r.min)
+		n.Div(n, step)
+		count.Add(count, n.Add(n, big.NewInt(1)))
+	}
+	return count, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var subnets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		subnets = append(subnets, subnet)
+	}
+	return subnets
+}
+
+func TestValidateSubnets(t *testing.T) {
+	valid := &IPMConfig{
+		Network:   "10.245.0.0/16",
+		SubnetLen: 24,
+		SubnetMin: "10.245.5.0",
+		SubnetMax: "10.245.50.0",
+		SubnetRanges: []SubnetRange{
+			{SubnetMin: "10.245.100.0", SubnetMax: "10.245.120.0"},
+		},
+	}
+	assert.NoError(t, valid.ValidateSubnets())
+
+	for name, config := range map[string]*IPMConfig{
+		"misaligned subnetMax": {Network: "10.245.0.0/16", SubnetLen: 24, SubnetMin: "10.245.5.0", SubnetMax: "10.245.50.7"},
+		"outside the network":  {Network: "10.245.0.0/16", SubnetLen: 24, SubnetMin: "10.245.5.0", SubnetMax: "10.246.0.0"},
+		"reversed":             {Network: "10.245.0.0/16", SubnetLen: 24, SubnetMin: "10.245.50.0", SubnetMax: "10.245.5.0"},
+		"subnetLen too short":  {Network: "10.245.0.0/16", SubnetLen: 8, SubnetMin: "10.245.0.0", SubnetMax: "10.245.0.0"},
+		"no range":             {Network: "10.245.0.0/16", SubnetLen: 24},
+		"overlapping ranges": {
+			Network:   "10.245.0.0/16",
+			SubnetLen: 24,
+			SubnetMin: "10.245.5.0",
+			SubnetMax: "10.245.50.0",
+			SubnetRanges: []SubnetRange{
+				{SubnetMin: "10.245.50.0", SubnetMax: "10.245.60.0"},
+			},
+		},
+	} {
+		assert.Error(t, config.ValidateSubnets(), name)
+	}
+}
+
+func TestNextSubnet(t *testing.T) {
+	config := &IPMConfig{
+		Network:   "10.245.0.0/16",
+		SubnetLen: 24,
+		SubnetRanges: []SubnetRange{
+			{SubnetMin: "10.245.100.0", SubnetMax: "10.245.101.0"},
+			{SubnetMin: "10.245.4.0", SubnetMax: "10.245.7.0"},
+		},
+	}
+
+	t.Run("first range", func(t *testing.T) {
+		subnet, err := NextSubnet(config, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.245.4.0/24", subnet.String())
+	})
+	t.Run("skips larger subnets", func(t *testing.T) {
+		subnet, err := NextSubnet(config, parseCIDRs("10.245.4.0/23", "10.245.6.0/24"))
+		assert.NoError(t, err)
+		assert.Equal(t, "10.245.7.0/24", subnet.String())
+	})
+	t.Run("next range", func(t *testing.T) {
+		subnet, err := NextSubnet(config, parseCIDRs("10.245.4.0/22", "10.245.100.0/24"))
+		assert.NoError(t, err)
+		assert.Equal(t, "10.245.101.0/24", subnet.String())
+	})
+	t.Run("exhausted", func(t *testing.T) {
+		_, err := NextSubnet(config, parseCIDRs("10.245.4.0/22", "10.245.100.0/23"))
+		assert.Error(t, err)
+	})
+	t.Run("large node", func(t *testing.T) {
+		large := *config
+		large.SubnetLen = 23
+		large.SubnetRanges = []SubnetRange{
+			{SubnetMin: "10.245.100.0", SubnetMax: "10.245.100.0"},
+			{SubnetMin: "10.245.4.0", SubnetMax: "10.245.6.0"},
+		}
+		subnet, err := NextSubnet(&large, parseCIDRs("10.245.5.0/24"))
+		assert.NoError(t, err)
+		assert.Equal(t, "10.245.6.0/23", subnet.String())
+
+		count, err := SubnetCount(&large)
+		assert.NoError(t, err)
+		assert.Equal(t, "3", count.String())
+	})
+	t.Run("ipv6", func(t *testing.T) {
+		v6 := &IPMConfig{
+			Network:   "fd00:245::/48",
+			SubnetLen: 64,
+			SubnetMin: "fd00:245:0:5::",
+			SubnetMax: "fd00:245:0:6::",
+		}
+		subnet, err := NextSubnet(v6, parseCIDRs("fd00:245:0:5::/64"))
+		assert.NoError(t, err)
+		assert.Equal(t, "fd00:245:0:6::/64", subnet.String())
+		assert.True(t, v6.InSubnetRanges(subnet))
+	})
+}
@@ -1,25 +1,287 @@
 package utils
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
 	"net"
+	"strings"
 )
 
 type IPMConfig struct {
-	Type                  string `json:"type"`
-	IPType                string `json:"ipType"`
-	Network               string `json:"network"`
-	SubnetLen             int    `json:"subnetLen"`
-	SubnetMin             string `json:"subnetMin"`
-	SubnetMax             string `json:"subnetMax"`
-	ETCDURL               string `json:"etcdURL"`
-	ETCDCertFile          string `json:"etcdCertFile"`
-	ETCDKeyFile           string `json:"etcdKeyFile"`
-	ETCDTrustedCAFileFile string `json:"etcdTrustedCAFileFile"`
+	Type      string `json:"type"`
+	IPType    string `json:"ipType"`
+	Network   string `json:"network"`
+	SubnetLen int    `json:"subnetLen"`
+	SubnetMin string `json:"subnetMin"`
+	SubnetMax string `json:"subnetMax"`
+	// SubnetRanges adds parent ranges the node subnets are carved from,
+	// besides subnetMin..subnetMax
+	SubnetRanges          []SubnetRange `json:"subnetRanges"`
+	ETCDURL               string        `json:"etcdURL"`
+	ETCDCertFile          string        `json:"etcdCertFile"`
+	ETCDKeyFile           string        `json:"etcdKeyFile"`
+	ETCDTrustedCAFileFile string        `json:"etcdTrustedCAFileFile"`
+
+	// ETCDEndpoints lists the members of the etcd cluster, used in place
+	// of ETCDURL. TLS is enabled by ETCDTLS, and otherwise only when an
+	// endpoint starts with https. ETCDTrustedCAFile is the correct
+	// spelling of ETCDTrustedCAFileFile, which is kept for old configs.
+	ETCDEndpoints     []string `json:"etcdEndpoints"`
+	ETCDUsername      string   `json:"etcdUsername"`
+	ETCDPassword      string   `json:"etcdPassword"`
+	ETCDTLS           *bool    `json:"etcdTLS"`
+	ETCDTrustedCAFile string   `json:"etcdTrustedCAFile"`
+	ETCDServerName    string   `json:"etcdServerName"`
+
+	// ETCDDialTimeout and ETCDRequestTimeout are in seconds, 5 by default.
+	// A request failing with a transient error is retried ETCDRetries
+	// times, 3 by default, with an exponential backoff.
+	ETCDDialTimeout    int  `json:"etcdDialTimeout"`
+	ETCDRequestTimeout int  `json:"etcdRequestTimeout"`
+	ETCDRetries        *int `json:"etcdRetries"`
+
+	// Store is "etcd" (the default) or "file", which keeps the state in
+	// the JSON file at StorePath for single node setups
+	Store     string `json:"store"`
+	StorePath string `json:"storePath"`
+	// LocalIPs keeps the IPs of the node in the file at LocalStorePath, in
+	// the node mode. Only the subnet of the node is registered in etcd.
+	LocalIPs       bool   `json:"localIPs"`
+	LocalStorePath string `json:"localStorePath"`
+
+	// LeaseTTL is the number of seconds a node may go without a heartbeat
+	// before its addresses and subnet are reclaimed. Zero disables leases.
+	LeaseTTL int64 `json:"leaseTTL"`
+	// LeaseMode is "reclaim" (the default) or "report", which only
+	// reports what would be reclaimed.
+	LeaseMode string `json:"leaseMode"`
+	// DeregisterExpiredNodes lets the heartbeat free the subnets of the
+	// nodes whose lease expired once they hold no IP, in the node mode
+	DeregisterExpiredNodes bool `json:"deregisterExpiredNodes"`
+
+	// Gateway, RangeStart and RangeEnd apply to the subnet containing them,
+	// which is the whole network in the cluster mode and the subnet of a
+	// single node in the node mode. Exclude lists IPs and CIDRs that are
+	// never allocated.
+	Gateway    string   `json:"gateway"`
+	RangeStart string   `json:"rangeStart"`
+	RangeEnd   string   `json:"rangeEnd"`
+	Exclude    []string `json:"exclude"`
+
+	// Routes and DNS are returned as is, like host-local does. In the node
+	// mode, ClusterRoute also adds a route to the whole network through
+	// the gateway of the node.
+	Routes       []*types.Route `json:"routes"`
+	DNS          types.DNS      `json:"dns"`
+	ClusterRoute bool           `json:"clusterRoute"`
+
+	// IPv6 holds the network, subnetLen, subnetMin and subnetMax of an
+	// IPv6 network allocated alongside the IPv4 one for dual-stack pods.
+	IPv6 *IPMConfig `json:"ipv6,omitempty"`
+
+	// StickyHoldTime keeps the IP of a Kubernetes pod reserved for that
+	// many seconds after its DEL, and gives it back to the next container
+	// of the same pod. Zero disables sticky IPs.
+	StickyHoldTime int64 `json:"stickyHoldTime"`
+
+	// NodeName names the node, instead of $CENTRALIP_NODE_NAME, the file
+	// at NodeNameFile or the hostname. The name the node registered with
+	// is recorded at NodeStatePath, so a renamed node keeps its subnet.
+	NodeName      string `json:"nodeName"`
+	NodeNameFile  string `json:"nodeNameFile"`
+	NodeStatePath string `json:"nodeStatePath"`
+
+	// Name is the name of the CNI network, which scopes all its etcd keys
+	Name string `json:"-"`
+	// Pod is the namespace/name of the Kubernetes pod from CNI_ARGS,
+	// which identifies its sticky IP
+	Pod string `json:"-"`
+}
+
+// IsIPv6 reports whether the config describes an IPv6 network
+func (config *IPMConfig) IsIPv6() bool {
+	addr := config.Network
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr = addr[:i]
+	}
+	if addr == "" {
+		addr = config.SubnetMin
+	}
+	if addr == "" && len(config.SubnetRanges) > 0 {
+		addr = config.SubnetRanges[0].SubnetMin
+	}
+
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
+
+// Families returns one config for each IP family to allocate from. The
+// config for the ipv6 block shares the etcd settings of the top level.
+func (config *IPMConfig) Families() ([]*IPMConfig, error) {
+	configs := []*IPMConfig{config}
+	if config.IPv6 == nil {
+		return configs, nil
+	}
+	if config.IsIPv6() {
+		return nil, fmt.Errorf("The ipv6 block requires an IPv4 network at the top level")
+	}
+
+	v6 := *config
+	v6.IPv6 = nil
+	v6.Network = config.IPv6.Network
+	v6.SubnetLen = config.IPv6.SubnetLen
+	v6.SubnetMin = config.IPv6.SubnetMin
+	v6.SubnetMax = config.IPv6.SubnetMax
+	v6.SubnetRanges = config.IPv6.SubnetRanges
+	v6.Gateway = config.IPv6.Gateway
+	v6.RangeStart = config.IPv6.RangeStart
+	v6.RangeEnd = config.IPv6.RangeEnd
+	v6.Exclude = config.IPv6.Exclude
+	v6.Routes = config.IPv6.Routes
+	if !v6.IsIPv6() {
+		return nil, fmt.Errorf("The network of the ipv6 block should be IPv6: %s", v6.Network)
+	}
+
+	return append(configs, &v6), nil
+}
+
+// ValidateRange checks that the gateway and the range belong to the
+// network, and parses the exclude list
+func (config *IPMConfig) ValidateRange() ([]*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(config.Network)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid network %q: %v", config.Network, err)
+	}
+
+	fields := []struct{ name, value string }{
+		{"gateway", config.Gateway},
+		{"rangeStart", config.RangeStart},
+		{"rangeEnd", config.RangeEnd},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		ip := net.ParseIP(f.value)
+		if ip == nil || !network.Contains(ip) {
+			return nil, fmt.Errorf("The %s %q is not in the network %s", f.name, f.value, config.Network)
+		}
+	}
+
+	if config.RangeStart != "" && config.RangeEnd != "" &&
+		IPToBigInt(net.ParseIP(config.RangeStart)).Cmp(IPToBigInt(net.ParseIP(config.RangeEnd))) > 0 {
+		return nil, fmt.Errorf("The rangeStart %s is after the rangeEnd %s", config.RangeStart, config.RangeEnd)
+	}
+
+	return ParseExclude(config.Exclude)
+}
+
+// ParseExclude parses a list of IPs and CIDRs, a single IP being a
+// network of one address
+func ParseExclude(exclude []string) ([]*net.IPNet, error) {
+	var ipnets []*net.IPNet
+	for _, e := range exclude {
+		if _, ipnet, err := net.ParseCIDR(e); err == nil {
+			ipnets = append(ipnets, ipnet)
+			continue
+		}
+
+		ip := net.ParseIP(e)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid exclude entry %q", e)
+		}
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		ipnets = append(ipnets, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+	}
+	return ipnets, nil
+}
+
+// KeyPrefix returns the etcd prefix holding the state of the network.
+// IPv6 networks live in their own subtree so that per-node keys of both
+// families don't collide.
+func (config *IPMConfig) KeyPrefix() string {
+	prefix := ETCDPrefix
+	if config.Name != "" {
+		prefix += config.Name + "/"
+	}
+	if config.IsIPv6() {
+		prefix += "ipv6/"
+	}
+	return prefix
+}
+
+// LegacyKeyPrefix returns the etcd prefix shared by all networks before
+// keys were scoped by network name
+func (config *IPMConfig) LegacyKeyPrefix() string {
+	legacy := *config
+	legacy.Name = ""
+	return legacy.KeyPrefix()
+}
+
+// ValidateName checks that the network name can scope etcd keys without
+// being mistaken for the unscoped layout
+func ValidateName(name string) error {
+	switch name {
+	case "node", "cluster", "ipv6":
+		return fmt.Errorf("The network name %q is reserved", name)
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("The network name %q must not contain '/'", name)
+	}
+	return nil
+}
+
+// Allocation records which container interface owns an IP address, and
+// the node it runs on. With sticky IPs, Pod is the namespace/name of the
+// Kubernetes pod, and Held marks an IP kept for the pod after its DEL.
+type Allocation struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	Node        string `json:"node,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	Held        bool   `json:"held,omitempty"`
+}
+
+func (a Allocation) String() string {
+	data, _ := json.Marshal(a)
+	return string(data)
+}
+
+// Owner returns the Allocation of a container interface on node, with the
+// pod identity of the config if sticky IPs are enabled
+func (config *IPMConfig) Owner(containerID, ifName, node string) Allocation {
+	a := Allocation{ContainerID: containerID, IfName: ifName, Node: node}
+	if config.StickyHoldTime > 0 {
+		a.Pod = config.Pod
+	}
+	return a
+}
+
+// Owns reports whether the stored owner of an IP is the same container
+// interface as a
+func (a Allocation) Owns(value string) bool {
+	stored := ParseAllocation(value)
+	return stored.ContainerID == a.ContainerID && stored.IfName == a.IfName
+}
+
+// ParseAllocation decodes the owner stored for an IP address. Older
+// versions stored the bare container ID.
+func ParseAllocation(value string) Allocation {
+	a := Allocation{}
+	if err := json.Unmarshal([]byte(value), &a); err != nil || a.ContainerID == "" {
+		return Allocation{ContainerID: value}
+	}
+	return a
 }
 
 type CentralIPM interface {
 	GetGateway() (string, error)
 	GetAvailableIP() (string, *net.IPNet, error)
+	GetRoutes() ([]*types.Route, error)
+	Check(ip net.IP) error
 	Delete() error
 }
 
@@ -15,15 +15,18 @@
 package utils
 
 import (
-	"context"
-	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/pkg/transport"
-	"time"
 	"encoding/binary"
 	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store/etcd"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store/file"
 	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/pkg/transport"
+	"math/big"
 	"net"
 	"strings"
+	"time"
 )
 
 func PowTwo(times int) uint32 {
@@ -57,7 +60,7 @@ func IntToIP(nn uint32) net.IP {
 	return ip
 }
 
-//We use the first IP as gateway address
+// We use the first IP as gateway address
 func GetNextIP(ipn *net.IPNet) net.IP {
 	nid := ipn.IP.Mask(ipn.Mask)
 	return ip.NextIP(nid)
@@ -68,74 +71,173 @@ func GetIPByInt(ip net.IP, n uint32) net.IP {
 	return IntToIP(i + n)
 }
 
+// IPToBigInt converts an IPv4 or IPv6 address to its integer value
+func IPToBigInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// BigIntToIP converts an integer back to an IPv4 or IPv6 address
+func BigIntToIP(n *big.Int, ipv6 bool) net.IP {
+	size := net.IPv4len
+	if ipv6 {
+		size = net.IPv6len
+	}
+
+	ip := make(net.IP, size)
+	b := n.Bytes()
+	if len(b) > size {
+		b = b[len(b)-size:]
+	}
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
+// AddToIP returns the address n positions after ip, in the same family
+func AddToIP(ip net.IP, n *big.Int) net.IP {
+	sum := new(big.Int).Add(IPToBigInt(ip), n)
+	return BigIntToIP(sum, ip.To4() == nil)
+}
+
+// HostCount returns the number of addresses in a prefix of length ones,
+// bits being 32 for IPv4 and 128 for IPv6.
+func HostCount(ones, bits int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
 /*
-	ETCD Related
+ETCD Related
 */
-func connectWithoutTLS(url string) (*clientv3.Client, error) {
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{url},
-		DialTimeout: 5 * time.Second,
-	})
+const (
+	defaultETCDTimeout = 5
+	defaultETCDRetries = 3
+)
+
+// etcdEndpoints returns the members of the etcd cluster, falling back to
+// ETCDURL
+func (config *IPMConfig) etcdEndpoints() []string {
+	if len(config.ETCDEndpoints) > 0 {
+		return config.ETCDEndpoints
+	}
+	return []string{config.ETCDURL}
+}
 
-	return cli, err
+func (config *IPMConfig) etcdTLSEnabled() bool {
+	if config.ETCDTLS != nil {
+		return *config.ETCDTLS
+	}
+	for _, endpoint := range config.etcdEndpoints() {
+		if strings.HasPrefix(endpoint, "https") {
+			return true
+		}
+	}
+	return false
 }
 
-func connectWithTLS(url, cert, key, trusted string) (*clientv3.Client, error) {
+func etcdClientConfig(config *IPMConfig) (clientv3.Config, error) {
+	dialTimeout := config.ETCDDialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultETCDTimeout
+	}
+	cfg := clientv3.Config{
+		Endpoints:   config.etcdEndpoints(),
+		DialTimeout: time.Duration(dialTimeout) * time.Second,
+		Username:    config.ETCDUsername,
+		Password:    config.ETCDPassword,
+	}
+	if !config.etcdTLSEnabled() {
+		return cfg, nil
+	}
+
+	trusted := config.ETCDTrustedCAFile
+	if trusted == "" {
+		trusted = config.ETCDTrustedCAFileFile
+	}
 	tlsInfo := transport.TLSInfo{
-		CertFile:      cert,
-		KeyFile:       key,
+		CertFile:      config.ETCDCertFile,
+		KeyFile:       config.ETCDKeyFile,
 		TrustedCAFile: trusted,
+		ServerName:    config.ETCDServerName,
 	}
-
 	tlsConfig, err := tlsInfo.ClientConfig()
 	if err != nil {
-		return nil, err
+		return cfg, err
 	}
-
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{url},
-		DialTimeout: 5 * time.Second,
-		TLS:         tlsConfig,
-	})
-
-	return cli, err
+	cfg.TLS = tlsConfig
+	return cfg, nil
 }
 
-
 func ConnectETCD(config *IPMConfig) (*clientv3.Client, error) {
-	var cli *clientv3.Client
-	var err error
-	if strings.HasPrefix(config.ETCDURL, "https") {
-		cli, err = connectWithTLS(config.ETCDURL, config.ETCDCertFile, config.ETCDKeyFile, config.ETCDTrustedCAFileFile)
-	} else {
-		cli, err = connectWithoutTLS(config.ETCDURL)
+	cfg, err := etcdClientConfig(config)
+	if err != nil {
+		return nil, err
 	}
+	return clientv3.New(cfg)
+}
 
-	return cli,err
+// Connect opens the store selected by the config, etcd by default
+func Connect(config *IPMConfig) (store.KV, error) {
+	switch config.Store {
+	case "", "etcd":
+		cli, err := ConnectETCD(config)
+		if err != nil {
+			return nil, err
+		}
+		opts := etcd.Options{
+			RequestTimeout: defaultETCDTimeout * time.Second,
+			Retries:        defaultETCDRetries,
+		}
+		if config.ETCDRequestTimeout > 0 {
+			opts.RequestTimeout = time.Duration(config.ETCDRequestTimeout) * time.Second
+		}
+		if config.ETCDRetries != nil {
+			opts.Retries = *config.ETCDRetries
+		}
+		return etcd.New(cli, opts), nil
+	case "file":
+		return file.New(config.StorePath)
+	default:
+		return nil, fmt.Errorf("Unsupport store %s", config.Store)
+	}
 }
 
+func DeleteKey(kv store.KV, key string) error {
+	return kv.Delete(key)
+}
 
-func DeleteKey(cli *clientv3.Client, prefix string) error {
-	_, err := cli.Delete(context.TODO(), prefix)
-	return err
+func PutValue(kv store.KV, key, value string, opts ...store.OpOption) error {
+	return kv.Put(key, value, opts...)
 }
-func PutValue(cli *clientv3.Client,prefix, value string) error {
-	_, err := cli.Put(context.TODO(), prefix, value)
-	return err
+
+// PutValueIfAbsent writes the key only if it doesn't exist yet and reports
+// whether it was written, so that concurrent writers can't both claim it.
+func PutValueIfAbsent(kv store.KV, key, value string, opts ...store.OpOption) (bool, error) {
+	return PutValuesIfAbsent(kv, map[string]string{key: value}, opts...)
 }
 
-func GetKeyValuesWithPrefix(cli *clientv3.Client, key string) (map[string]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	resp, err := cli.Get(ctx, key, clientv3.WithPrefix())
-	cancel()
-	if err != nil {
-		return nil, fmt.Errorf("Fetch etcd prefix error:%v", err)
+// PutValuesIfAbsent writes all the keys in one transaction, only if none
+// of them exists yet.
+func PutValuesIfAbsent(kv store.KV, keyValues map[string]string, opts ...store.OpOption) (bool, error) {
+	var cmps []store.Cmp
+	var ops []store.Op
+	for k, v := range keyValues {
+		cmps = append(cmps, store.Absent(k))
+		ops = append(ops, store.OpPut(k, v, opts...))
 	}
+	return kv.Txn(cmps, ops, nil)
+}
 
-	results := make(map[string]string)
-	for _, ev := range resp.Kvs {
-		results[string(ev.Key)] = string(ev.Value)
+// GetValue returns the value of a single key and whether it exists
+func GetValue(kv store.KV, key string) (string, bool, error) {
+	result, err := kv.Get(key)
+	if err != nil || result == nil {
+		return "", false, err
 	}
+	return result.Value, true, nil
+}
 
-	return results, nil
+func GetKeyValuesWithPrefix(kv store.KV, key string) (map[string]string, error) {
+	return kv.List(key)
 }
@@ -16,8 +16,10 @@ package utils
 
 import (
 	"github.com/stretchr/testify/assert"
+	"math/big"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestPowOfTwo(t *testing.T) {
@@ -60,3 +62,160 @@ func TestGetIpByInt(t *testing.T) {
 	assert.Equal(t, GetIPByInt(net, uint32(200)).String(), "192.168.194.200")
 	assert.Equal(t, GetIPByInt(net, uint32(300)).String(), "192.168.195.44")
 }
+
+func TestBigIntConversion(t *testing.T) {
+	v4 := IPToBigInt(net.ParseIP("127.0.0.1"))
+	assert.Equal(t, "2130706433", v4.String())
+	assert.Equal(t, "127.0.0.1", BigIntToIP(v4, false).String())
+
+	v6 := IPToBigInt(net.ParseIP("2001:db8::e13"))
+	assert.Equal(t, "2001:db8::e13", BigIntToIP(v6, true).String())
+}
+
+func TestAddToIP(t *testing.T) {
+	assert.Equal(t, "192.168.195.44", AddToIP(net.ParseIP("192.168.194.0"), big.NewInt(300)).String())
+	assert.Equal(t, "2001:db8::1:0", AddToIP(net.ParseIP("2001:db8::ffff"), big.NewInt(1)).String())
+	assert.Equal(t, "2001:db8:0:1::", AddToIP(net.ParseIP("2001:db8::"), HostCount(64, 128)).String())
+}
+
+func TestHostCount(t *testing.T) {
+	assert.Equal(t, "256", HostCount(24, 32).String())
+	assert.Equal(t, "1", HostCount(32, 32).String())
+	assert.Equal(t, "18446744073709551616", HostCount(64, 128).String())
+}
+
+func TestFamilies(t *testing.T) {
+	t.Run("single stack", func(t *testing.T) {
+		config := &IPMConfig{Network: "10.245.0.0/16", ETCDURL: "127.0.0.1:2379"}
+		families, err := config.Families()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(families))
+		assert.False(t, families[0].IsIPv6())
+		assert.Equal(t, ETCDPrefix, families[0].KeyPrefix())
+	})
+	t.Run("dual stack", func(t *testing.T) {
+		config := &IPMConfig{
+			IPType:  "node",
+			Network: "10.245.0.0/16",
+			ETCDURL: "127.0.0.1:2379",
+			IPv6: &IPMConfig{
+				Network:   "fd00:245::/48",
+				SubnetLen: 64,
+				SubnetMin: "fd00:245:0:5::",
+				SubnetMax: "fd00:245:0:6::",
+				Gateway:   "fd00:245:0:5::1",
+			},
+			Gateway: "10.245.5.1",
+		}
+		families, err := config.Families()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(families))
+		assert.Equal(t, "fd00:245:0:5::1", families[1].Gateway)
+		assert.True(t, families[1].IsIPv6())
+		assert.Equal(t, "node", families[1].IPType)
+		assert.Equal(t, "127.0.0.1:2379", families[1].ETCDURL)
+		assert.Equal(t, "fd00:245:0:5::", families[1].SubnetMin)
+		assert.Equal(t, ETCDPrefix+"ipv6/", families[1].KeyPrefix())
+	})
+	t.Run("invalid ipv6 block", func(t *testing.T) {
+		config := &IPMConfig{
+			Network: "10.245.0.0/16",
+			IPv6:    &IPMConfig{Network: "10.246.0.0/16"},
+		}
+		_, err := config.Families()
+		assert.Error(t, err)
+	})
+}
+
+func TestETCDClientConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := etcdClientConfig(&IPMConfig{ETCDURL: "127.0.0.1:2379"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"127.0.0.1:2379"}, cfg.Endpoints)
+		assert.Equal(t, 5*time.Second, cfg.DialTimeout)
+		assert.Nil(t, cfg.TLS)
+	})
+	t.Run("cluster with auth", func(t *testing.T) {
+		cfg, err := etcdClientConfig(&IPMConfig{
+			ETCDURL:         "127.0.0.1:2379",
+			ETCDEndpoints:   []string{"10.0.0.1:2379", "10.0.0.2:2379", "10.0.0.3:2379"},
+			ETCDUsername:    "centralip",
+			ETCDPassword:    "secret",
+			ETCDDialTimeout: 10,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1:2379", "10.0.0.2:2379", "10.0.0.3:2379"}, cfg.Endpoints)
+		assert.Equal(t, "centralip", cfg.Username)
+		assert.Equal(t, "secret", cfg.Password)
+		assert.Equal(t, 10*time.Second, cfg.DialTimeout)
+	})
+	t.Run("tls", func(t *testing.T) {
+		enabled, disabled := true, false
+		cfg, err := etcdClientConfig(&IPMConfig{ETCDEndpoints: []string{"10.0.0.1:2379"}, ETCDTLS: &enabled, ETCDServerName: "etcd"})
+		assert.NoError(t, err)
+		assert.Equal(t, "etcd", cfg.TLS.ServerName)
+
+		cfg, err = etcdClientConfig(&IPMConfig{ETCDURL: "https://127.0.0.1:2379", ETCDTLS: &disabled})
+		assert.NoError(t, err)
+		assert.Nil(t, cfg.TLS)
+
+		//The CA file of the old option is still read
+		_, err = etcdClientConfig(&IPMConfig{ETCDURL: "https://127.0.0.1:2379", ETCDTrustedCAFileFile: "/nonexistent/ca.crt"})
+		assert.Error(t, err)
+		_, err = etcdClientConfig(&IPMConfig{ETCDURL: "https://127.0.0.1:2379", ETCDTrustedCAFile: "/nonexistent/ca.crt"})
+		assert.Error(t, err)
+	})
+}
+
+func TestValidateRange(t *testing.T) {
+	config := &IPMConfig{
+		Network:    "10.245.0.0/16",
+		Gateway:    "10.245.0.1",
+		RangeStart: "10.245.0.10",
+		RangeEnd:   "10.245.0.100",
+		Exclude:    []string{"10.245.0.20", "10.245.0.32/28"},
+	}
+	exclude, err := config.ValidateRange()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(exclude))
+	assert.Equal(t, "10.245.0.20/32", exclude[0].String())
+	assert.Equal(t, "10.245.0.32/28", exclude[1].String())
+
+	invalid := *config
+	invalid.Gateway = "10.246.0.1"
+	_, err = invalid.ValidateRange()
+	assert.Error(t, err)
+
+	invalid = *config
+	invalid.RangeStart = "10.245.0.200"
+	_, err = invalid.ValidateRange()
+	assert.Error(t, err)
+
+	invalid = *config
+	invalid.Exclude = []string{"10.245.0"}
+	_, err = invalid.ValidateRange()
+	assert.Error(t, err)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	config := &IPMConfig{Network: "10.245.0.0/16", Name: "mynet"}
+	assert.Equal(t, ETCDPrefix+"mynet/", config.KeyPrefix())
+	assert.Equal(t, ETCDPrefix, config.LegacyKeyPrefix())
+
+	config = &IPMConfig{Network: "fd00:245::/48", Name: "mynet"}
+	assert.Equal(t, ETCDPrefix+"mynet/ipv6/", config.KeyPrefix())
+	assert.Equal(t, ETCDPrefix+"ipv6/", config.LegacyKeyPrefix())
+}
+
+func TestValidateName(t *testing.T) {
+	assert.NoError(t, ValidateName("mynet"))
+	assert.Error(t, ValidateName("node"))
+	assert.Error(t, ValidateName("cluster"))
+	assert.Error(t, ValidateName("my/net"))
+}
+
+func TestParseAllocation(t *testing.T) {
+	a := Allocation{ContainerID: "abc", IfName: "eth0"}
+	assert.Equal(t, a, ParseAllocation(a.String()))
+	assert.Equal(t, Allocation{ContainerID: "legacy"}, ParseAllocation("legacy"))
+}
@@ -0,0 +1,570 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// centralipctl inspects and repairs the pool of a centralip network.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/containers"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/events"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/metrics"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: centralipctl [-conf file] <command> [args]
+
+Commands:
+  subnets                     list the subnet of each node or namespace
+  ips                         list the used IPs with their container
+  usage                       show how much of the pool is allocated
+  check                       validate the node and subnet keys against each other
+  fsck [flags]                find the inconsistent keys of the network as JSON,
+                              run "centralipctl fsck -h" for its flags
+  release-ip <ip>             free an IP, as if its container ran DEL
+  release-subnet <node|cidr>  free the subnet of a node or namespace with all its IPs
+  deregister <node>           free the subnet of a node or namespace without any IP
+  reconcile [flags]           free the IPs of the containers that are gone,
+                              run "centralipctl reconcile -h" for its flags
+  export [file]               write the state of the network as JSON, to stdout by default
+  import <file>               restore the state written by export
+  import-host-local [flags]   seed the IPs reserved by host-local on this node,
+                              run "centralipctl import-host-local -h" for its flags
+  metrics [-listen addr]      serve the pool usage as Prometheus metrics
+  events [flags]              stream the allocation and subnet events as JSON,
+                              run "centralipctl events -h" for its flags
+`
+
+type network struct {
+	kv     store.KV
+	config *utils.IPMConfig
+}
+
+// errUsage fails a command line that doesn't name a known command
+var errUsage = errors.New("invalid command line")
+
+func main() {
+	switch err := run(os.Args[1:], os.Stdout); err {
+	case nil:
+	case flag.ErrHelp:
+		os.Exit(0)
+	case errUsage:
+		os.Exit(2)
+	default:
+		log.Fatal(err)
+	}
+}
+
+// run runs the command line args, printing to stdout
+func run(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("centralipctl", flag.ContinueOnError)
+	confFile := flags.String("conf", "/etc/cni/net.d/ovs.conf", "the CNI network config using centralip")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	data, err := ioutil.ReadFile(*confFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", *confFile, err)
+	}
+	n, families, err := centralip.LoadIPMConfigs(data)
+	if err != nil {
+		return err
+	}
+
+	var networks []network
+	for _, config := range families {
+		kv, err := utils.Connect(config)
+		if err != nil {
+			return fmt.Errorf("failed to connect to the store: %v", err)
+		}
+		defer kv.Close()
+		networks = append(networks, network{kv: kv, config: config})
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	args = flags.Args()
+	switch args[0] {
+	case "subnets":
+		return listSubnets(w, networks)
+	case "ips":
+		return listIPs(w, networks)
+	case "usage":
+		return showUsage(w, networks)
+	case "check":
+		return check(w, networks)
+	case "fsck":
+		return fsck(stdout, networks, args[1:])
+	case "release-ip":
+		if len(args) != 2 {
+			return fmt.Errorf("release-ip takes the IP to free")
+		}
+		return releaseIP(networks, args[1])
+	case "release-subnet":
+		if len(args) != 2 {
+			return fmt.Errorf("release-subnet takes the node or the subnet to free")
+		}
+		return releaseSubnet(networks, args[1])
+	case "deregister":
+		if len(args) != 2 {
+			return fmt.Errorf("deregister takes the node to free")
+		}
+		return deregister(networks, args[1])
+	case "reconcile":
+		return reconcile(w, networks, args[1:])
+	case "export":
+		if len(args) > 2 {
+			return fmt.Errorf("export takes the file to write, if any")
+		}
+		return export(stdout, networks, args[1:])
+	case "import":
+		if len(args) != 2 {
+			return fmt.Errorf("import takes the file written by export")
+		}
+		return restore(stdout, networks, args[1])
+	case "import-host-local":
+		return importHostLocal(stdout, networks, n.Name, args[1:])
+	case "metrics":
+		return serveMetrics(networks, args[1:])
+	case "events":
+		return streamEvents(stdout, networks, args[1:])
+	default:
+		flags.Usage()
+		return errUsage
+	}
+}
+
+// nodeFlag adds -node to flags, defaulting to the name of this node. The
+// returned function fails if the name is needed but can't be resolved.
+func nodeFlag(flags *flag.FlagSet, config *utils.IPMConfig, usage string) (*string, func() error) {
+	hostname, nameErr := utils.NodeName(config)
+	node := flags.String("node", hostname, usage)
+	return node, func() error {
+		set := false
+		flags.Visit(func(f *flag.Flag) {
+			set = set || f.Name == "node"
+		})
+		if nameErr != nil && !set {
+			return nameErr
+		}
+		return nil
+	}
+}
+
+func nodeNetworks(networks []network) ([]network, error) {
+	var nodes []network
+	for _, n := range networks {
+		if n.config.IPType == "node" || n.config.IPType == "namespace" {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("subnets only exist in the node and namespace modes")
+	}
+	return nodes, nil
+}
+
+// ownerColumn names the owners of the subnets, which are namespaces in the
+// namespace mode
+func ownerColumn(networks []network) string {
+	if networks[0].config.IPType == "namespace" {
+		return "NAMESPACE"
+	}
+	return "NODE"
+}
+
+func listSubnets(w *tabwriter.Writer, networks []network) error {
+	nodes, err := nodeNetworks(networks)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s\tSUBNET\n", ownerColumn(nodes))
+	for _, n := range nodes {
+		subnets, err := utils.NodeSubnets(n.kv, n.config)
+		if err != nil {
+			return err
+		}
+		var hosts []string
+		for host := range subnets {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			fmt.Fprintf(w, "%s\t%s\n", host, subnets[host])
+		}
+	}
+	return nil
+}
+
+func listIPs(w *tabwriter.Writer, networks []network) error {
+	fmt.Fprintln(w, "IP\tCONTAINER\tIFNAME\tNODE")
+	for _, n := range networks {
+		ips, err := utils.UsedIPs(n.kv, n.config)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ip.IP, ip.Owner.ContainerID, ip.Owner.IfName, ip.Owner.Node)
+		}
+	}
+	return nil
+}
+
+func showUsage(w *tabwriter.Writer, networks []network) error {
+	fmt.Fprintf(w, "SUBNET\t%s\tUSED\tSIZE\n", ownerColumn(networks))
+	for _, n := range networks {
+		usages, err := utils.PoolUsage(n.kv, n.config)
+		if err != nil {
+			return err
+		}
+		for _, u := range usages {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", u.Subnet, u.Node, u.Used, u.Size)
+		}
+
+		if n.config.IPType == "node" || n.config.IPType == "namespace" {
+			count, err := utils.SubnetCount(n.config)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%d of the %s subnets of %s are assigned\n", len(usages), count, n.config.Network)
+		}
+	}
+	return nil
+}
+
+func check(w *tabwriter.Writer, networks []network) error {
+	nodes, err := nodeNetworks(networks)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, n := range nodes {
+		found, err := utils.CheckSubnets(n.kv, n.config)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, found...)
+	}
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d inconsistencies", len(problems))
+	}
+	fmt.Fprintln(w, "the node and subnet keys are consistent")
+	return nil
+}
+
+func fsck(stdout io.Writer, networks []network, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix the problems found, in one transaction per IP family")
+	maxTxnOps := flags.Int("max-txn-ops", utils.DefaultMaxTxnOps, "the --max-txn-ops of etcd, which limits the size of the repair")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var reports []*utils.FsckReport
+	var problems int
+	var err error
+	for _, n := range networks {
+		report, fsckErr := utils.Fsck(n.kv, n.config, *repair, *maxTxnOps)
+		if report != nil {
+			reports = append(reports, report)
+			if !report.Repaired {
+				problems += len(report.Problems)
+			}
+		}
+		if fsckErr != nil {
+			err = fsckErr
+			break
+		}
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if encodeErr := encoder.Encode(reports); encodeErr != nil {
+		return encodeErr
+	}
+	if err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d inconsistencies", problems)
+	}
+	return nil
+}
+
+func releaseIP(networks []network, value string) error {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return fmt.Errorf("invalid IP %q", value)
+	}
+	for _, n := range networks {
+		if n.config.IsIPv6() == (ip.To4() == nil) {
+			return utils.ReleaseIP(n.kv, n.config, ip)
+		}
+	}
+	return fmt.Errorf("the network has no IP family for %s", ip)
+}
+
+func releaseSubnet(networks []network, name string) error {
+	nodes, err := nodeNetworks(networks)
+	if err != nil {
+		return err
+	}
+
+	if _, subnet, err := net.ParseCIDR(name); err == nil {
+		for _, n := range nodes {
+			if n.config.IsIPv6() == (subnet.IP.To4() == nil) {
+				return utils.ReleaseSubnet(n.kv, n.config, name)
+			}
+		}
+		return fmt.Errorf("the network has no IP family for %s", subnet)
+	}
+
+	//A node holds a subnet of each family, so release them all
+	for _, n := range nodes {
+		if err := utils.ReleaseSubnet(n.kv, n.config, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deregister(networks []network, host string) error {
+	nodes, err := nodeNetworks(networks)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if err := utils.DeregisterNode(n.kv, n.config, host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reconcile(w *tabwriter.Writer, networks []network, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	file := flags.String("containers", "", "a file listing the live container IDs, one per line")
+	cri := flags.String("cri", "", "the CRI socket to list the live pods from with crictl")
+	kubernetes := flags.Bool("kubernetes", false, "list the live pods from the Kubernetes API, with the service account of the pod")
+	node, nodeErr := nodeFlag(flags, networks[0].config, "only reconcile the IPs of this node, empty for all the nodes")
+	dryRun := flags.Bool("dry-run", false, "only show what would be marked and released")
+	maxRelease := flags.Int("max-release", 10, "refuse to release more than this percentage of the allocated IPs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	//Without a node name, reconcile would cover every node
+	if err := nodeErr(); err != nil {
+		return err
+	}
+
+	var source containers.Source
+	switch {
+	case *file != "":
+		source = &containers.FileSource{Path: *file}
+	case *cri != "":
+		source = &containers.CRISource{Endpoint: *cri}
+	case *kubernetes:
+		k8s, err := containers.NewInClusterSource(*node)
+		if err != nil {
+			return err
+		}
+		source = k8s
+	default:
+		return fmt.Errorf("reconcile needs one of -containers, -cri or -kubernetes")
+	}
+
+	live, err := source.Live()
+	if err != nil {
+		return err
+	}
+
+	opts := utils.ReconcileOptions{Node: *node, DryRun: *dryRun, MaxRelease: *maxRelease}
+	fmt.Fprintln(w, "IP\tCONTAINER\tIFNAME\tNODE\tACTION")
+	for _, n := range networks {
+		result, err := utils.Reconcile(n.kv, n.config, live, opts)
+		if result != nil {
+			for _, used := range result.Marked {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\tmarked\n", used.IP, used.Owner.ContainerID, used.Owner.IfName, used.Owner.Node)
+			}
+			for _, used := range result.Released {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\treleased\n", used.IP, used.Owner.ContainerID, used.Owner.IfName, used.Owner.Node)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if *dryRun {
+		fmt.Fprintln(w, "dry run, nothing was changed")
+	}
+	return nil
+}
+
+func families(networks []network) []*utils.IPMConfig {
+	var configs []*utils.IPMConfig
+	for _, n := range networks {
+		configs = append(configs, n.config)
+	}
+	return configs
+}
+
+func export(stdout io.Writer, networks []network, args []string) error {
+	backup, err := utils.Export(networks[0].kv, families(networks))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if len(args) == 0 {
+		_, err = stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(args[0], data, 0600)
+}
+
+func restore(stdout io.Writer, networks []network, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	backup := &utils.Backup{}
+	if err := json.Unmarshal(data, backup); err != nil {
+		return fmt.Errorf("failed to load %s: %v", file, err)
+	}
+	imported, err := utils.Import(networks[0].kv, families(networks), backup)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d keys imported\n", imported)
+	return nil
+}
+
+func importHostLocal(stdout io.Writer, networks []network, name string, args []string) error {
+	flags := flag.NewFlagSet("import-host-local", flag.ContinueOnError)
+	dir := flags.String("dir", utils.HostLocalDir(name), "the directory where host-local keeps the IPs of the network")
+	node, nodeErr := nodeFlag(flags, networks[0].config, "the node the IPs belong to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := nodeErr(); err != nil {
+		return err
+	}
+
+	for _, n := range networks {
+		imported, err := utils.ImportHostLocal(n.kv, n.config, *node, *dir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%d IPs of %s imported\n", imported, n.config.Network)
+	}
+	return nil
+}
+
+func serveMetrics(networks []network, args []string) error {
+	flags := flag.NewFlagSet("metrics", flag.ContinueOnError)
+	listen := flags.String("listen", ":9153", "the address to serve /metrics on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var watched []metrics.Network
+	for _, n := range networks {
+		watched = append(watched, metrics.Network{KV: n.kv, Config: n.config})
+	}
+	collector := metrics.NewCollector(watched)
+	collector.Watch(context.Background())
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return err
+	}
+	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	log.Infof("serving metrics on %s", *listen)
+	return http.ListenAndServe(*listen, nil)
+}
+
+func streamEvents(stdout io.Writer, networks []network, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	listen := flags.String("listen", "", "the address to serve /events on, instead of printing the events")
+	revision := flags.Int64("revision", 0, "resume at this revision instead of starting with a snapshot")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	kv := networks[0].kv
+	if *listen != "" {
+		http.Handle("/events", events.Handler(kv, families(networks)))
+		log.Infof("serving events on %s", *listen)
+		return http.ListenAndServe(*listen, nil)
+	}
+
+	encoder := json.NewEncoder(stdout)
+	if *revision == 0 {
+		snapshot, next, err := events.Snapshot(kv, families(networks))
+		if err != nil {
+			return err
+		}
+		for _, event := range snapshot {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+		*revision = next
+		encoder.Encode(events.Event{Version: events.Version, Revision: next - 1, Type: events.Synced})
+	}
+	for event := range events.Watch(context.Background(), kv, families(networks), *revision) {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+		if event.Type == events.Compacted {
+			return fmt.Errorf("the revision %d was compacted, start over without -revision", *revision)
+		}
+	}
+	return nil
+}
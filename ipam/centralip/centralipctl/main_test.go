@@ -0,0 +1,183 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConf = `
+	{
+		"name":"ctl-test",
+		"cniVersion":"0.3.1",
+		"ipam":{
+			"type":"central",
+			"ipType": "node",
+			"network":"10.151.0.0/16",
+			"subnetLen": 24,
+			"subnetMin": "10.151.1.0",
+			"subnetMax": "10.151.2.0",
+			"store": "file",
+			"storePath": "%s"%s
+		}
+	}
+	`
+
+// writeConf writes the network config of the test as dir/name, with extra
+// fields in its ipam block, and returns its path
+func writeConf(t *testing.T, dir, name, extra string) string {
+	conf := filepath.Join(dir, name)
+	data := fmt.Sprintf(testConf, filepath.Join(dir, "store.json"), extra)
+	assert.NoError(t, ioutil.WriteFile(conf, []byte(data), 0644))
+	return conf
+}
+
+func runCommand(conf string, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(append([]string{"-conf", conf}, args...), &out)
+	return out.String(), err
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "centralipctl")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf := writeConf(t, dir, "ctl.conf", `,"nodeName": "node1"`)
+
+	data, err := ioutil.ReadFile(conf)
+	assert.NoError(t, err)
+	_, families, err := centralip.LoadIPMConfigs(data)
+	assert.NoError(t, err)
+	config := families[0]
+	kv, err := utils.Connect(config)
+	assert.NoError(t, err)
+	prefix := config.KeyPrefix() + "node/"
+	for k, v := range map[string]string{
+		"node1":                    "10.151.1.0/24",
+		"subnets/10.151.1.0/24":    "node1",
+		"node1/used/10.151.1.2":    utils.Allocation{ContainerID: "c1", IfName: "eth0", Node: "node1"}.String(),
+		"node1/containers/c1/eth0": "10.151.1.2",
+		"node2":                    "10.151.2.0/24",
+		"subnets/10.151.2.0/24":    "node2",
+	} {
+		assert.NoError(t, utils.PutValue(kv, prefix+k, v))
+	}
+	kv.Close()
+
+	t.Run("usage", func(t *testing.T) {
+		_, err := runCommand(conf)
+		assert.Equal(t, errUsage, err)
+		_, err = runCommand(conf, "unknown")
+		assert.Equal(t, errUsage, err)
+		_, err = runCommand(conf, "-h")
+		assert.Equal(t, flag.ErrHelp, err)
+		_, err = runCommand(filepath.Join(dir, "missing.conf"), "subnets")
+		assert.Error(t, err)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		out, err := runCommand(conf, "subnets")
+		assert.NoError(t, err)
+		assert.Equal(t, "NODE   SUBNET\nnode1  10.151.1.0/24\nnode2  10.151.2.0/24\n", out)
+
+		out, err = runCommand(conf, "ips")
+		assert.NoError(t, err)
+		assert.Contains(t, out, "10.151.1.2  c1         eth0    node1")
+
+		out, err = runCommand(conf, "check")
+		assert.NoError(t, err)
+		assert.Contains(t, out, "consistent")
+	})
+
+	t.Run("fsck flags", func(t *testing.T) {
+		out, err := runCommand(conf, "fsck", "-repair", "-max-txn-ops", "10")
+		assert.NoError(t, err)
+		assert.Contains(t, out, `"repaired"`)
+		_, err = runCommand(conf, "fsck", "-unknown")
+		assert.Error(t, err)
+	})
+
+	t.Run("arguments", func(t *testing.T) {
+		for _, command := range []string{"release-ip", "release-subnet", "deregister", "import"} {
+			_, err := runCommand(conf, command)
+			assert.Error(t, err, command)
+		}
+		_, err := runCommand(conf, "export", "a", "b")
+		assert.Error(t, err)
+		_, err = runCommand(conf, "release-ip", "not-an-ip")
+		assert.Error(t, err)
+	})
+
+	t.Run("export and import", func(t *testing.T) {
+		out, err := runCommand(conf, "export")
+		assert.NoError(t, err)
+		assert.Contains(t, out, "10.151.1.2")
+
+		backup := filepath.Join(dir, "backup.json")
+		_, err = runCommand(conf, "export", backup)
+		assert.NoError(t, err)
+		out, err = runCommand(conf, "import", backup)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(out, "keys imported\n"))
+	})
+
+	t.Run("node name", func(t *testing.T) {
+		live := filepath.Join(dir, "live")
+		assert.NoError(t, ioutil.WriteFile(live, []byte("c1\n"), 0644))
+		out, err := runCommand(conf, "reconcile", "-containers", live, "-dry-run")
+		assert.NoError(t, err)
+		assert.Contains(t, out, "dry run")
+
+		//A node name that can't be read fails instead of covering all nodes
+		broken := writeConf(t, dir, "broken.conf", `,"nodeNameFile": "`+filepath.Join(dir, "missing")+`"`)
+		_, err = runCommand(broken, "reconcile", "-containers", live, "-dry-run")
+		assert.Error(t, err)
+		_, err = runCommand(broken, "import-host-local", "-dir", dir)
+		assert.Error(t, err)
+
+		out, err = runCommand(broken, "reconcile", "-containers", live, "-dry-run", "-node", "node1")
+		assert.NoError(t, err)
+		assert.Contains(t, out, "dry run")
+		out, err = runCommand(broken, "import-host-local", "-dir", dir, "-node", "node1")
+		assert.NoError(t, err)
+		assert.Contains(t, out, "0 IPs of 10.151.0.0/16 imported")
+	})
+
+	t.Run("release", func(t *testing.T) {
+		_, err := runCommand(conf, "deregister", "node1")
+		assert.Error(t, err)
+		_, err = runCommand(conf, "release-ip", "10.151.1.2")
+		assert.NoError(t, err)
+		_, err = runCommand(conf, "deregister", "node1")
+		assert.NoError(t, err)
+		_, err = runCommand(conf, "release-subnet", "10.151.2.0/24")
+		assert.NoError(t, err)
+
+		out, err := runCommand(conf, "subnets")
+		assert.NoError(t, err)
+		assert.Equal(t, "NODE  SUBNET\n", out)
+	})
+}
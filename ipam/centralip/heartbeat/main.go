@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// heartbeat keeps the centralip lease of a node alive, so that the
+// addresses and subnet of the node are only reclaimed once it stops.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"time"
+
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+type network struct {
+	kv     store.KV
+	config *utils.IPMConfig
+}
+
+func main() {
+	confFile := flag.String("conf", "/etc/cni/net.d/ovs.conf", "the CNI network config using centralip")
+	node := flag.String("hostname", "", "the name of the node, found like the plugin does by default")
+	flag.Parse()
+
+	data, err := ioutil.ReadFile(*confFile)
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", *confFile, err)
+	}
+
+	_, families, err := centralip.LoadIPMConfigs(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *node == "" {
+		*node, err = utils.NodeName(families[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var networks []network
+	interval := time.Duration(0)
+	for _, config := range families {
+		if config.LeaseTTL == 0 {
+			continue
+		}
+		kv, err := utils.Connect(config)
+		if err != nil {
+			log.Fatalf("failed to connect to the store: %v", err)
+		}
+		defer kv.Close()
+		networks = append(networks, network{kv: kv, config: config})
+
+		// Renew three times per TTL so that one missed heartbeat is harmless
+		ttl := time.Duration(config.LeaseTTL) * time.Second / 3
+		if interval == 0 || ttl < interval {
+			interval = ttl
+		}
+	}
+	if len(networks) == 0 {
+		log.Fatalf("the leaseTTL of %s is not set", *confFile)
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for {
+		for _, n := range networks {
+			beat(n, *node)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// beat renews the lease of the node, deregisters the expired nodes if
+// asked to and, in the report mode, logs what the reclaim mode would have
+// freed
+func beat(n network, node string) {
+	if _, err := utils.NodeLease(n.kv, n.config, node); err != nil {
+		log.Warnf("failed to renew the lease of %s: %v", node, err)
+		return
+	}
+
+	if n.config.DeregisterExpiredNodes {
+		nodes, err := utils.DeregisterExpiredNodes(n.kv, n.config)
+		if err != nil {
+			log.Warnf("failed to deregister expired nodes: %v", err)
+		}
+		for _, expired := range nodes {
+			log.Infof("the lease of %s expired, its subnet was released", expired)
+		}
+	}
+
+	if n.config.LeaseMode != utils.LeaseModeReport {
+		return
+	}
+	expired, err := utils.ExpiredKeys(n.kv, n.config)
+	if err != nil {
+		log.Warnf("failed to list expired keys: %v", err)
+		return
+	}
+	for key, owner := range expired {
+		log.Infof("the lease of %s expired, %s would be reclaimed", owner, key)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
-	//	"strings"
 	"github.com/John-Lin/ovs-cni/ipam/centralip/backend"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
@@ -11,31 +13,54 @@ import (
 )
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "centralip: an IPAM plugin backed by etcd")
 }
 
-/*
-
-type CmdArgs struct {
-	ContainerID string
-	Netns       string
-	IfName      string
-	Args        string
-	Path        string
-	StdinData   []byte
-}
-
-*/
 func cmdAdd(args *skel.CmdArgs) error {
-	n, err, cniversion := centralip.GenerateCentralIPM(args)
+	if err := centralip.TrackNodeNames(args); err != nil {
+		return err
+	}
+	ipms, err, cniversion := centralip.GenerateCentralIPM(args)
 	if err != nil {
 		return err
 	}
 
+	conf, _, err := centralip.LoadIPMConfigs(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	result := &current.Result{Routes: []*types.Route{}, DNS: conf.IPM.DNS}
+	for i, n := range ipms {
+		ipconfig, routes, err := allocate(n)
+		if err != nil {
+			// Give back the addresses of the other families
+			for _, allocated := range ipms[:i] {
+				allocated.Delete()
+			}
+			return err
+		}
+		result.IPs = append(result.IPs, ipconfig)
+		result.Routes = append(result.Routes, routes...)
+	}
+	return types.PrintResult(result, cniversion)
+}
+
+func allocate(n utils.CentralIPM) (*current.IPConfig, []*types.Route, error) {
 	gwIP, err := n.GetGateway()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	_, IP, err := n.GetAvailableIP()
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	routes, err := n.GetRoutes()
+	if err != nil {
+		n.Delete()
+		return nil, nil, err
 	}
 
 	i := net.ParseIP(gwIP)
@@ -44,28 +69,71 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if IP.IP.To4() == nil {
 		version = "6"
 	}
-	ipconfig := &current.IPConfig{
+	return &current.IPConfig{
 		Version: version,
 		Address: *IP,
 		Gateway: i,
+	}, routes, nil
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	ipms, err, _ := centralip.GenerateCentralIPM(args)
+	if err != nil {
+		return err
 	}
 
-	result := &current.Result{}
-	result.IPs = append(result.IPs, ipconfig)
-	result.Routes = []*types.Route{}
-	return types.PrintResult(result, cniversion)
+	var firstErr error
+	for _, n := range ipms {
+		if err := n.Delete(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-func cmdDel(args *skel.CmdArgs) error {
-	n, err, _ := centralip.GenerateCentralIPM(args)
+// cmdCheck verifies that every address of prevResult is still allocated to
+// the container, so that CHECK fails once another container owns it
+func cmdCheck(args *skel.CmdArgs) error {
+	ipms, err, _ := centralip.GenerateCentralIPM(args)
 	if err != nil {
 		return err
 	}
 
-	err = n.Delete()
+	_, families, err := centralip.LoadIPMConfigs(args.StdinData)
 	if err != nil {
 		return err
 	}
 
+	conf := &types.NetConf{}
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if conf.RawPrevResult == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
+	if err := version.ParsePrevResult(conf); err != nil {
+		return err
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	for i, n := range ipms {
+		var ip net.IP
+		for _, ipc := range result.IPs {
+			if (ipc.Address.IP.To4() == nil) == families[i].IsIPv6() {
+				ip = ipc.Address.IP
+				break
+			}
+		}
+		if ip == nil {
+			return fmt.Errorf("The prevResult has no address of the network %s", families[i].Network)
+		}
+
+		if err := n.Check(ip); err != nil {
+			return err
+		}
+	}
 	return nil
 }
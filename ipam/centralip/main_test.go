@@ -0,0 +1,215 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/store"
+	"github.com/John-Lin/ovs-cni/ipam/centralip/backend/utils"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const nodeConf = `
+	{
+		"name":"main-node",
+		"cniVersion":"0.4.0",
+		"ipam":{
+			"type":"central",
+			"ipType": "node",
+			"network":"10.150.0.0/16",
+			"subnetLen": 24,
+			"subnetMin": "10.150.1.0",
+			"subnetMax": "10.150.2.0",
+			"nodeName": "node1",
+			"store": "file",
+			"storePath": "%s",
+			"nodeStatePath": "%s"
+		}%s
+	}
+	`
+
+const dualStackConf = `
+	{
+		"name":"main-dual",
+		"cniVersion":"0.4.0",
+		"ipam":{
+			"type":"central",
+			"ipType": "cluster",
+			"network":"10.152.0.0/16",
+			"store": "file",
+			"storePath": "%s",
+			"nodeStatePath": "%s",
+			"ipv6": {
+				"network":"fd00:152::/64",
+				"rangeStart": "fd00:152::2",
+				"rangeEnd": "fd00:152::2"
+			}
+		}%s
+	}
+	`
+
+// testConf fills conf with the paths of a temporary directory, and returns
+// it along with the store of the network
+func testConf(t *testing.T, conf string) (string, store.KV, *utils.IPMConfig, func()) {
+	dir, err := ioutil.TempDir("", "centralip")
+	assert.NoError(t, err)
+	conf = strings.Replace(conf, `"%s"`, `"`+filepath.Join(dir, "store.json")+`"`, 1)
+	conf = strings.Replace(conf, `"%s"`, `"`+filepath.Join(dir, "node.json")+`"`, 1)
+
+	_, families, err := centralip.LoadIPMConfigs([]byte(fmt.Sprintf(conf, "")))
+	assert.NoError(t, err)
+	kv, err := utils.Connect(families[0])
+	assert.NoError(t, err)
+	return conf, kv, families[0], func() {
+		kv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// withPrevResult returns the args of a CNI call on conf, with result as
+// its prevResult if not nil
+func withPrevResult(t *testing.T, containerID, conf string, result *current.Result) *skel.CmdArgs {
+	prev := ""
+	if result != nil {
+		data, err := json.Marshal(result)
+		assert.NoError(t, err)
+		prev = `,"prevResult":` + string(data)
+	}
+	return &skel.CmdArgs{
+		ContainerID: containerID,
+		IfName:      "eth0",
+		StdinData:   []byte(fmt.Sprintf(conf, prev)),
+	}
+}
+
+// add runs cmdAdd and returns the result it prints
+func add(t *testing.T, args *skel.CmdArgs) (*current.Result, error) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	os.Stdout = w
+	err = cmdAdd(args)
+	w.Close()
+	os.Stdout = stdout
+	data, _ := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := current.NewResult(data)
+	if err != nil {
+		return nil, err
+	}
+	return current.GetResult(res)
+}
+
+func TestCheck(t *testing.T) {
+	conf, kv, config, cleanup := testConf(t, nodeConf)
+	defer cleanup()
+	prefix := config.KeyPrefix() + "node/"
+
+	result, err := add(t, withPrevResult(t, "pod1", conf, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(result.IPs))
+	assert.Equal(t, "10.150.1.2/24", result.IPs[0].Address.String())
+	assert.NoError(t, cmdCheck(withPrevResult(t, "pod1", conf, result)))
+
+	t.Run("no prevResult", func(t *testing.T) {
+		assert.Error(t, cmdCheck(withPrevResult(t, "pod1", conf, nil)))
+	})
+
+	t.Run("missing allocation", func(t *testing.T) {
+		err := cmdCheck(withPrevResult(t, "pod2", conf, result))
+		assert.Contains(t, fmt.Sprint(err), "There aren't any allocation")
+	})
+
+	t.Run("another IP", func(t *testing.T) {
+		other := *result
+		ipc := *result.IPs[0]
+		ipc.Address = net.IPNet{IP: net.ParseIP("10.150.1.9").To4(), Mask: ipc.Address.Mask}
+		other.IPs = []*current.IPConfig{&ipc}
+		err := cmdCheck(withPrevResult(t, "pod1", conf, &other))
+		assert.Contains(t, fmt.Sprint(err), "instead of 10.150.1.9")
+	})
+
+	t.Run("foreign owner", func(t *testing.T) {
+		key := prefix + "node1/used/10.150.1.2"
+		value, _, err := utils.GetValue(kv, key)
+		assert.NoError(t, err)
+		assert.NoError(t, utils.PutValue(kv, key, utils.Allocation{ContainerID: "pod9", IfName: "eth0", Node: "node1"}.String()))
+		err = cmdCheck(withPrevResult(t, "pod1", conf, result))
+		assert.Contains(t, fmt.Sprint(err), "is now owned by")
+		assert.NoError(t, utils.PutValue(kv, key, value))
+		assert.NoError(t, cmdCheck(withPrevResult(t, "pod1", conf, result)))
+	})
+
+	t.Run("subnet of another node", func(t *testing.T) {
+		key := prefix + "subnets/10.150.1.0/24"
+		assert.NoError(t, utils.PutValue(kv, key, "node2"))
+		err := cmdCheck(withPrevResult(t, "pod1", conf, result))
+		assert.Contains(t, fmt.Sprint(err), "no longer belongs to node1")
+		assert.NoError(t, utils.PutValue(kv, key, "node1"))
+	})
+}
+
+func TestAddDel(t *testing.T) {
+	conf, kv, _, cleanup := testConf(t, dualStackConf)
+	defer cleanup()
+	_, families, err := centralip.LoadIPMConfigs([]byte(fmt.Sprintf(conf, "")))
+	assert.NoError(t, err)
+	used := func() []string {
+		var ips []string
+		for _, family := range families {
+			usedIPs, err := utils.UsedIPs(kv, family)
+			assert.NoError(t, err)
+			for _, used := range usedIPs {
+				ips = append(ips, used.IP.String())
+			}
+		}
+		return ips
+	}
+
+	result, err := add(t, withPrevResult(t, "pod1", conf, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(result.IPs))
+	assert.Equal(t, "10.152.0.2/16", result.IPs[0].Address.String())
+	assert.Equal(t, "fd00:152::2/64", result.IPs[1].Address.String())
+	assert.Equal(t, []string{"10.152.0.2", "fd00:152::2"}, used())
+	assert.NoError(t, cmdCheck(withPrevResult(t, "pod1", conf, result)))
+
+	//The IPv6 range is full, so the IPv4 address is given back
+	_, err = add(t, withPrevResult(t, "pod2", conf, nil))
+	assert.Error(t, err)
+	assert.Equal(t, []string{"10.152.0.2", "fd00:152::2"}, used())
+
+	assert.NoError(t, cmdDel(withPrevResult(t, "pod1", conf, nil)))
+	assert.Empty(t, used())
+	//DEL runs again when the runtime retries it
+	assert.NoError(t, cmdDel(withPrevResult(t, "pod1", conf, nil)))
+
+	result, err = add(t, withPrevResult(t, "pod2", conf, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00:152::2/64", result.IPs[1].Address.String())
+}
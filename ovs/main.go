@@ -1,20 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/John-Lin/ovs-cni/ovs/backend/disk"
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
-	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils"
 
@@ -27,6 +29,8 @@ const defaultBrName = "br0"
 
 const defaultDataDir = "/var/lib/cni/networks"
 
+const dadTimeout = 10 * time.Second
+
 type NetConf struct {
 	types.NetConf
 	OVSBrName   string   `json:"ovsBridge"`
@@ -35,6 +39,8 @@ type NetConf struct {
 	IPMasq      bool     `json:"ipMasq"`
 	VtepIPs     []string `json:"vtepIPs"`
 	Controller  string   `json:"controller,omitempty"`
+	DisableDAD  bool     `json:"disableDAD"`
+	WaitDAD     bool     `json:"waitDAD"`
 }
 
 type gwInfo struct {
@@ -238,7 +244,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	// run the IPAM plugin and get back the config to apply
-	r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+	r, err := invoke.DelegateAdd(context.TODO(), n.IPAM.Type, args.StdinData, nil)
 	if err != nil {
 		return err
 	}
@@ -261,6 +267,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	hasV6 := false
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() == nil {
+			hasV6 = true
+		}
+	}
+
 	// Configure the container hardware address and IP address(es)
 	if err := netns.Do(func(_ ns.NetNS) error {
 		contVeth, err := net.InterfaceByName(args.IfName)
@@ -268,14 +281,40 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return err
 		}
 
-		if err := ipam.ConfigureIface(args.IfName, result); err != nil {
+		if hasV6 && n.DisableDAD {
+			if err := disableDAD(args.IfName); err != nil {
+				return fmt.Errorf("failed to disable DAD on %q: %v", args.IfName, err)
+			}
+		}
+		// Without disableDAD or waitDAD the kernel announces the addresses
+		// itself once DAD completes
+		if hasV6 && !n.DisableDAD && !n.WaitDAD {
+			if err := enableNdiscNotify(args.IfName); err != nil {
+				return fmt.Errorf("failed to enable ndisc_notify on %q: %v", args.IfName, err)
+			}
+		}
+
+		if err := configureIface(args.IfName, result); err != nil {
 			return err
 		}
 
-		// Send a gratuitous arp
+		// IPv6 addresses can't be announced while they are tentative
+		announceV6 := n.DisableDAD
+		if hasV6 && n.WaitDAD && !n.DisableDAD {
+			if err := waitForDAD(args.IfName, dadTimeout); err != nil {
+				return err
+			}
+			announceV6 = true
+		}
+
+		// Send a gratuitous arp or an unsolicited neighbor advertisement
 		for _, ipc := range result.IPs {
-			if ipc.Version == "4" {
+			if ipc.Address.IP.To4() != nil {
 				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
+			} else if announceV6 {
+				if err := sendUnsolicitedNA(ipc.Address.IP, *contVeth); err != nil {
+					log.Warnf("failed to send unsolicited neighbor advertisement for %v: %v", ipc.Address.IP, err)
+				}
 			}
 		}
 		return nil
@@ -292,13 +331,23 @@ func cmdAdd(args *skel.CmdArgs) error {
 					firstV4Addr = gw.IP
 				}
 
+				if gws.family == netlink.FAMILY_V6 && n.DisableDAD {
+					if err = disableDAD(br.BridgeName); err != nil {
+						return fmt.Errorf("failed to disable DAD on %q: %v", br.BridgeName, err)
+					}
+				}
+
 				err = ensureBridgeAddr(br, gws.family, &gw)
 				if err != nil {
 					return fmt.Errorf("failed to set bridge addr: %v", err)
 				}
 			}
 
-			if gws.gws != nil {
+			if gws.gws != nil && gws.family == netlink.FAMILY_V6 {
+				if err = enableIPv6Gateway(br.BridgeName); err != nil {
+					return fmt.Errorf("failed to enable IPv6 forwarding: %v", err)
+				}
+			} else if gws.gws != nil {
 				if err = enableIPForward(gws.family); err != nil {
 					return fmt.Errorf("failed to enable forwarding: %v", err)
 				}
@@ -324,7 +373,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
 		for _, ipc := range result.IPs {
-			if err = ip.SetupIPMasq(ip.Network(&ipc.Address), chain, comment); err != nil {
+			if err = setupIPMasq(ip.Network(&ipc.Address), chain, comment); err != nil {
 				return err
 			}
 		}
@@ -339,7 +388,7 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+	if err := invoke.DelegateDel(context.TODO(), n.IPAM.Type, args.StdinData, nil); err != nil {
 		return err
 	}
 
@@ -369,10 +418,10 @@ func cmdDel(args *skel.CmdArgs) error {
 	// There is a netns so try to clean up. Delete can be called multiple times
 	// so don't return an error if the device is already removed.
 	// If the device isn't there then don't try to clean up IP masq either.
-	var ipnets *net.IPNet
+	var ipnets []*net.IPNet
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
 		var err error
-		ipnets, err = ip.DelLinkByNameAddr(args.IfName, netlink.FAMILY_ALL)
+		ipnets, err = delLinkByNameAddrs(args.IfName)
 		if err != nil && err == ip.ErrLinkNotFound {
 			return nil
 		}
@@ -386,8 +435,10 @@ func cmdDel(args *skel.CmdArgs) error {
 	if n.IPMasq {
 		chain := utils.FormatChainName(n.Name, args.ContainerID)
 		comment := utils.FormatComment(n.Name, args.ContainerID)
-		if err := ip.TeardownIPMasq(ipnets, chain, comment); err != nil {
-			return err
+		for _, ipn := range ipnets {
+			if err := teardownIPMasq(ip.Network(ipn), chain, comment); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -395,5 +446,6 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	// CHECK needs a cniVersion of 0.4.0, so the ovs plugin never gets it
+	skel.PluginMain(cmdAdd, nil, cmdDel, version.PluginSupports("0.1.0", "0.2.0", "0.3.0", "0.3.1"), "ovs-cni: an Open vSwitch CNI plugin")
 }
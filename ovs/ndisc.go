@@ -0,0 +1,78 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	icmpv6NeighborAdvertisement = 136
+	ndOptTargetLinkLayerAddr    = 2
+	// ndFlagOverride asks receivers to replace any cached link-layer address
+	ndFlagOverride = 0x20
+)
+
+// neighborAdvertisement builds an ICMPv6 neighbor advertisement for target
+// carrying mac as the target link-layer address option. The checksum is
+// left zero since the kernel fills it in for raw ICMPv6 sockets.
+func neighborAdvertisement(target net.IP, mac net.HardwareAddr) []byte {
+	msg := make([]byte, 24, 24+2+len(mac))
+	msg[0] = icmpv6NeighborAdvertisement
+	msg[4] = ndFlagOverride
+	copy(msg[8:24], target.To16())
+
+	// option length is counted in units of 8 octets
+	optLen := (2 + len(mac) + 7) / 8
+	opt := make([]byte, optLen*8)
+	opt[0] = ndOptTargetLinkLayerAddr
+	opt[1] = byte(optLen)
+	copy(opt[2:], mac)
+	return append(msg, opt...)
+}
+
+// sendUnsolicitedNA announces the IPv6 address to all nodes on the link,
+// which is the IPv6 counterpart of a gratuitous ARP
+func sendUnsolicitedNA(addr net.IP, iface net.Interface) error {
+	if addr.To4() != nil || addr.To16() == nil {
+		return fmt.Errorf("%v is not an IPv6 address", addr)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// Neighbor discovery messages must be sent with a hop limit of 255
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index); err != nil {
+		return err
+	}
+
+	src := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(src.Addr[:], addr.To16())
+	if err := syscall.Bind(fd, src); err != nil {
+		return fmt.Errorf("failed to bind to %v: %v", addr, err)
+	}
+
+	dst := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(dst.Addr[:], net.IPv6linklocalallnodes)
+	return syscall.Sendto(fd, neighborAdvertisement(addr, iface.HardwareAddr), 0, dst)
+}
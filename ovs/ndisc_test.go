@@ -0,0 +1,39 @@
+// Copyright (c) 2017 Che Wei, Lin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestNeighborAdvertisement(t *testing.T) {
+	target := net.ParseIP("2001:db8::5")
+	mac, _ := net.ParseMAC("0a:58:0a:f4:01:05")
+
+	msg := neighborAdvertisement(target, mac)
+	assert.Equal(t, 32, len(msg))
+	assert.Equal(t, byte(136), msg[0])
+	assert.Equal(t, byte(0x20), msg[4])
+	assert.Equal(t, target.String(), net.IP(msg[8:24]).String())
+	assert.Equal(t, []byte{2, 1}, msg[24:26])
+	assert.Equal(t, mac.String(), net.HardwareAddr(msg[26:32]).String())
+}
+
+func TestSendUnsolicitedNA_Invalid(t *testing.T) {
+	err := sendUnsolicitedNA(net.ParseIP("10.244.1.5"), net.Interface{Index: 1})
+	assert.Error(t, err)
+}
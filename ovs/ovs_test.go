@@ -38,6 +38,21 @@ func TestLoadNetConf(t *testing.T) {
 		assert.Equal(t, s, "0.3.1")
 		assert.Equal(t, "br0", n.OVSBrName)
 	})
+	t.Run("IPv6 DAD", func(t *testing.T) {
+		config := string(`
+		{
+			"name":"mynet",
+			"cniVersion":"0.3.1",
+			"type":"ovs",
+			"disableDAD": true
+		}
+		`)
+
+		n, _, err := loadNetConf([]byte(config))
+		assert.NoError(t, err)
+		assert.True(t, n.DisableDAD)
+		assert.False(t, n.WaitDAD)
+	})
 	t.Run("InValid", func(t *testing.T) {
 		config := string(`
 		{
@@ -16,10 +16,15 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containernetworking/plugins/pkg/ip"
+	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 )
 
@@ -44,6 +49,138 @@ func enableIPForward(family int) error {
 	return ip.EnableIP6Forward()
 }
 
+// getSysctl reads the value of a sysctl such as "net/ipv6/conf/all/forwarding"
+func getSysctl(name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc/sys", name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// setSysctl writes the value of a sysctl such as "net/ipv6/conf/all/forwarding"
+func setSysctl(name, value string) error {
+	return ioutil.WriteFile(filepath.Join("/proc/sys", name), []byte(value), 0644)
+}
+
+// disableDAD turns off IPv6 duplicate address detection on the interface,
+// so that addresses are usable as soon as they are assigned
+func disableDAD(ifName string) error {
+	return setSysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_dad", ifName), "0")
+}
+
+// enableNdiscNotify makes the kernel send an unsolicited neighbor
+// advertisement for each IPv6 address on the interface once it is usable
+func enableNdiscNotify(ifName string) error {
+	return setSysctl(fmt.Sprintf("net/ipv6/conf/%s/ndisc_notify", ifName), "1")
+}
+
+// enableIPv6Gateway prepares the bridge to route IPv6 traffic for pods.
+// Enabling forwarding makes the kernel ignore router advertisements on
+// interfaces with accept_ra=1, which would drop the default route of hosts
+// configured by SLAAC, so those interfaces are switched to accept_ra=2 when
+// forwarding is first switched on. The bridge itself never accepts router
+// advertisements sent by pods.
+func enableIPv6Gateway(brName string) error {
+	forwarding, err := getSysctl("net/ipv6/conf/all/forwarding")
+	if err != nil {
+		return err
+	}
+
+	if forwarding != "1" {
+		confs, err := ioutil.ReadDir("/proc/sys/net/ipv6/conf")
+		if err != nil {
+			return err
+		}
+
+		for _, conf := range confs {
+			switch conf.Name() {
+			case "all", "default", "lo", brName:
+				continue
+			}
+			acceptRA := fmt.Sprintf("net/ipv6/conf/%s/accept_ra", conf.Name())
+			if value, err := getSysctl(acceptRA); err == nil && value == "1" {
+				if err := setSysctl(acceptRA, "2"); err != nil {
+					return err
+				}
+				log.Infof("set accept_ra of %s to 2 to keep its router advertisements with IPv6 forwarding", conf.Name())
+			}
+		}
+	}
+
+	if err := setSysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", brName), "0"); err != nil {
+		return err
+	}
+	if err := enableIPForward(netlink.FAMILY_V6); err != nil {
+		return err
+	}
+	return setSysctl(fmt.Sprintf("net/ipv6/conf/%s/forwarding", brName), "1")
+}
+
+// waitForDAD blocks until none of the IPv6 addresses on the link is
+// tentative any more, or fails if duplicate address detection failed
+func waitForDAD(ifName string, timeout time.Duration) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return err
+		}
+
+		tentative := false
+		for _, addr := range addrs {
+			if addr.Flags&syscall.IFA_F_DADFAILED != 0 {
+				return fmt.Errorf("duplicate address detection failed for %v", addr.IP)
+			}
+			if addr.Flags&syscall.IFA_F_TENTATIVE != 0 {
+				tentative = true
+			}
+		}
+		if !tentative {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for duplicate address detection on %s", ifName)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// delLinkByNameAddrs removes the link and returns the global unicast
+// addresses it had, unlike ip.DelLinkByNameAddr which only returns the first
+func delLinkByNameAddrs(ifName string) ([]*net.IPNet, error) {
+	iface, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if err.Error() == "Link not found" {
+			return nil, ip.ErrLinkNotFound
+		}
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	addrs, err := netlink.AddrList(iface, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+	}
+
+	if err = netlink.LinkDel(iface); err != nil {
+		return nil, fmt.Errorf("failed to delete %q: %v", ifName, err)
+	}
+
+	var ipnets []*net.IPNet
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			ipnets = append(ipnets, addr.IPNet)
+		}
+	}
+	return ipnets, nil
+}
+
 //We use the first IP as gateway address
 func getNextIP(ipn *net.IPNet) net.IP {
 	nid := ipn.IP.Mask(ipn.Mask)
@@ -76,3 +76,15 @@ func TestGetGatewayFromIP(t *testing.T) {
 	gwIP := getNextIP(input)
 	assert.Equal(t, gwIP.String(), "192.168.192.1")
 }
+
+func TestGetSysctl(t *testing.T) {
+	if _, err := os.Stat("/proc/sys/net/ipv4/ip_forward"); os.IsNotExist(err) {
+		t.SkipNow()
+	}
+	value, err := getSysctl("net/ipv4/ip_forward")
+	assert.NoError(t, err)
+	assert.Contains(t, []string{"0", "1"}, value)
+
+	_, err = getSysctl("net/ipv4/unknown")
+	assert.Error(t, err)
+}